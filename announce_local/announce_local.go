@@ -0,0 +1,281 @@
+package announce_local
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// the udp port ZeroNet clients broadcast on
+const BROADCAST_PORT = 1544
+
+const SERVICE = "zeronet"
+
+// how often we ask the LAN who is there
+const DISCOVER_INTERVAL = 5 * time.Minute
+
+// site hashes per siteListResponse, to stay below the udp size limit
+const SITES_PER_MESSAGE = 100
+
+// Sites gives access to the sites we serve
+type Sites interface {
+	Addresses() []string
+	AddLocalPeer(address string, p *peer.Peer) bool
+}
+
+type Sender struct {
+	Service        string `msgpack:"service"`
+	PeerID         string `msgpack:"peer_id"`
+	Rev            int    `msgpack:"rev"`
+	BroadcastPort  int    `msgpack:"broadcast_port"`
+	FileserverPort int    `msgpack:"fileserver_port"`
+	IP             string `msgpack:"ip"`
+}
+
+type Message struct {
+	Cmd    string                 `msgpack:"cmd"`
+	Params map[string]interface{} `msgpack:"params"`
+	Sender Sender                 `msgpack:"sender"`
+}
+
+// Announcer finds other clients on the LAN by udp broadcast, the way ZeroNet's AnnounceLocal does,
+// and hands them to the sites both sides serve
+type Announcer struct {
+	Port  int
+	Conn  *net.UDPConn
+	Sites Sites
+	// sites_changed of both sides at the last exchange per peer id, lists are asked again when one changes
+	known map[string]string
+	done  chan struct{}
+	sync.Mutex
+}
+
+func NewAnnouncer(port int, sites Sites) *Announcer {
+	return &Announcer{
+		Port:  port,
+		Sites: sites,
+		known: map[string]string{},
+		done:  make(chan struct{}),
+	}
+}
+
+func (a *Announcer) Listen() error {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: a.Port})
+	if err != nil {
+		return err
+	}
+	a.Conn = conn
+	return nil
+}
+
+// Serve answers the LAN and broadcasts a discover request every DISCOVER_INTERVAL
+func (a *Announcer) Serve() {
+	go a.discoverLoop()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := a.Conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-a.done:
+				return
+			default:
+			}
+			continue
+		}
+		msg := Message{}
+		if err := msgpack.Unmarshal(buf[:n], &msg); err != nil {
+			continue
+		}
+		if msg.Sender.Service != SERVICE || msg.Sender.PeerID == utils.GetPeerID() {
+			continue
+		}
+		msg.Sender.IP = addr.IP.String()
+		a.handle(&msg, addr)
+	}
+}
+
+func (a *Announcer) Stop() {
+	close(a.done)
+	a.Conn.Close()
+}
+
+func (a *Announcer) discoverLoop() {
+	ticker := time.NewTicker(DISCOVER_INTERVAL)
+	defer ticker.Stop()
+	for {
+		a.Discover()
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover broadcasts a discover request on every interface
+func (a *Announcer) Discover() {
+	msg := a.message("discoverRequest", map[string]interface{}{"sites_changed": a.sitesChanged()})
+	for _, addr := range broadcastAddresses() {
+		a.send(msg, &net.UDPAddr{IP: addr, Port: a.Port})
+	}
+}
+
+func (a *Announcer) handle(msg *Message, addr *net.UDPAddr) {
+	// answers go to the port the sender listens on, not the one it sent from
+	back := &net.UDPAddr{IP: addr.IP, Port: msg.Sender.BroadcastPort}
+	if back.Port == 0 {
+		back.Port = addr.Port
+	}
+	switch msg.Cmd {
+	case "discoverRequest":
+		a.send(a.message("discoverResponse", map[string]interface{}{"sites_changed": a.sitesChanged()}), back)
+		a.requestSites(msg, back)
+	case "discoverResponse":
+		a.requestSites(msg, back)
+	case "siteListRequest":
+		for _, res := range a.siteLists() {
+			a.send(res, back)
+		}
+	case "siteListResponse":
+		a.addPeer(msg)
+	}
+}
+
+// requestSites asks for the site list of a peer unless we already matched its current one with ours
+func (a *Announcer) requestSites(msg *Message, back *net.UDPAddr) {
+	changed := fmt.Sprintf("%v-%d", msg.Params["sites_changed"], a.sitesChanged())
+	a.Lock()
+	known, ok := a.known[msg.Sender.PeerID]
+	a.known[msg.Sender.PeerID] = changed
+	a.Unlock()
+	if ok && known == changed {
+		return
+	}
+	a.send(a.message("siteListRequest", map[string]interface{}{}), back)
+}
+
+func (a *Announcer) siteLists() []Message {
+	hashes := [][]byte{}
+	for _, address := range a.Sites.Addresses() {
+		hash := sha256.Sum256([]byte(address))
+		hashes = append(hashes, hash[:])
+	}
+	res := []Message{}
+	for len(hashes) > 0 {
+		n := len(hashes)
+		if n > SITES_PER_MESSAGE {
+			n = SITES_PER_MESSAGE
+		}
+		res = append(res, a.message("siteListResponse", map[string]interface{}{
+			"sites_changed": a.sitesChanged(),
+			"sites":         hashes[:n],
+		}))
+		hashes = hashes[n:]
+	}
+	return res
+}
+
+// addPeer adds the sender to every site of its list we serve too
+func (a *Announcer) addPeer(msg *Message) {
+	if msg.Sender.FileserverPort == 0 {
+		return
+	}
+	sites, _ := msg.Params["sites"].([]interface{})
+	theirs := map[string]bool{}
+	for _, s := range sites {
+		switch s := s.(type) {
+		case []byte:
+			theirs[string(s)] = true
+		case string:
+			theirs[s] = true
+		}
+	}
+	added := 0
+	for _, address := range a.Sites.Addresses() {
+		hash := sha256.Sum256([]byte(address))
+		if !theirs[string(hash[:])] {
+			continue
+		}
+		p := peer.NewPeerFromAddress(msg.Sender.IP, msg.Sender.FileserverPort)
+		if p != nil && a.Sites.AddLocalPeer(address, p) {
+			added++
+		}
+	}
+	log.WithFields(log.Fields{
+		"peer":  msg.Sender.IP,
+		"sites": added,
+	}).Debug("LAN peer found")
+}
+
+func (a *Announcer) message(cmd string, params map[string]interface{}) Message {
+	return Message{
+		Cmd:    cmd,
+		Params: params,
+		Sender: Sender{
+			Service:        SERVICE,
+			PeerID:         utils.GetPeerID(),
+			Rev:            utils.REV,
+			BroadcastPort:  a.Port,
+			FileserverPort: utils.GetFileserverPort(),
+		},
+	}
+}
+
+func (a *Announcer) send(msg Message, addr *net.UDPAddr) {
+	data, err := msgpack.Marshal(msg)
+	if err == nil {
+		_, err = a.Conn.WriteToUDP(data, addr)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"addr": addr,
+			"err":  err,
+		}).Debug("LAN announce error")
+	}
+}
+
+// sitesChanged identifies our current site list, peers ask for it again when it changes
+func (a *Announcer) sitesChanged() int64 {
+	addresses := a.Sites.Addresses()
+	sort.Strings(addresses)
+	h := fnv.New32a()
+	for _, address := range addresses {
+		h.Write([]byte(address))
+	}
+	return int64(h.Sum32())
+}
+
+// broadcastAddresses returns the broadcast address of every ipv4 network we are on
+func broadcastAddresses() []net.IP {
+	res := []net.IP{net.IPv4bcast}
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.IsLoopback() || ipnet.IP.To4() == nil {
+			continue
+		}
+		ip := ipnet.IP.To4()
+		mask := net.IP(ipnet.Mask).To4()
+		if mask == nil {
+			mask = net.IP(ipnet.Mask[len(ipnet.Mask)-4:])
+		}
+		bcast := make(net.IP, 4)
+		for i := range ip {
+			bcast[i] = ip[i] | ^mask[i]
+		}
+		if !bytes.Equal(bcast, net.IPv4bcast.To4()) {
+			res = append(res, bcast)
+		}
+	}
+	return res
+}
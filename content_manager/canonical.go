@@ -0,0 +1,145 @@
+package content_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// Canonical serializes a decoded json value the way ZeroNet signs it:
+// python's json.dumps(value, sort_keys=True), so ascii only, ", " and ": " separators and python float reprs.
+// Numbers have to be decoded with UseNumber to keep integers exact.
+func Canonical(value interface{}) ([]byte, error) {
+	buf := bytes.Buffer{}
+	if err := writeCanonical(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		if v {
+			buf.WriteString("true")
+		} else {
+			buf.WriteString("false")
+		}
+	case json.Number:
+		s, err := pythonNumber(v)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(s)
+	case float64:
+		buf.WriteString(pythonFloat(v))
+	case string:
+		writeString(buf, v)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]interface{}:
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			writeString(buf, k)
+			buf.WriteString(": ")
+			if err := writeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return fmt.Errorf("Can't serialize %T", value)
+	}
+	return nil
+}
+
+// pythonNumber keeps integers as they are and writes floats like python's repr
+func pythonNumber(n json.Number) (string, error) {
+	s := n.String()
+	if !strings.ContainsAny(s, ".eE") {
+		i, ok := new(big.Int).SetString(s, 10)
+		if !ok {
+			return "", fmt.Errorf("Bad number %s", s)
+		}
+		return i.String(), nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return "", err
+	}
+	return pythonFloat(f), nil
+}
+
+func pythonFloat(f float64) string {
+	exp := 0
+	if f != 0 {
+		// the exponent of the shortest repr decides between fixed and scientific notation
+		e := strconv.FormatFloat(f, 'e', -1, 64)
+		exp, _ = strconv.Atoi(e[strings.Index(e, "e")+1:])
+	}
+	if exp < -4 || exp >= 16 {
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	if !strings.Contains(s, ".") {
+		s += ".0"
+	}
+	return s
+}
+
+// writeString escapes like python's json with ensure_ascii
+func writeString(buf *bytes.Buffer, s string) {
+	buf.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		default:
+			if r >= 0x20 && r < 0x7f {
+				buf.WriteRune(r)
+			} else if r > 0xffff {
+				r1, r2 := utf16.EncodeRune(r)
+				fmt.Fprintf(buf, `\u%04x\u%04x`, r1, r2)
+			} else {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
@@ -0,0 +1,55 @@
+package content_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+// expected outputs are python's json.dumps(json.loads(input), sort_keys=True)
+var canonicalCases = []struct {
+	input    string
+	expected string
+}{
+	{`0.00001`, `1e-05`},
+	{`1E-5`, `1e-05`},
+	{`0.0001`, `0.0001`},
+	{`1e16`, `1e+16`},
+	{`1e+16`, `1e+16`},
+	{`1e21`, `1e+21`},
+	{`123456789012345.6`, `123456789012345.6`},
+	{`1234567890123456.7`, `1234567890123456.8`},
+	{`2.50`, `2.5`},
+	{`3.0`, `3.0`},
+	{`-0.0`, `-0.0`},
+	{`1491574467.435`, `1491574467.435`},
+	{`-5`, `-5`},
+	{`123456789012345678901234`, `123456789012345678901234`},
+	{`"\u007f"`, `"\u007f"`},
+	{`"\u001f"`, `"\u001f"`},
+	{`"café"`, `"caf\u00e9"`},
+	{`"😀"`, `"\ud83d\ude00"`},
+	{`"tab\there"`, `"tab\there"`},
+	{`"a/b"`, `"a/b"`},
+	{`"\"q\" \\"`, `"\"q\" \\"`},
+	{`{"b": 1, "a": [true, null, false], "c": {}}`, `{"a": [true, null, false], "b": 1, "c": {}}`},
+	{`[]`, `[]`},
+}
+
+func TestCanonical(t *testing.T) {
+	for _, c := range canonicalCases {
+		decoder := json.NewDecoder(bytes.NewReader([]byte(c.input)))
+		decoder.UseNumber()
+		var value interface{}
+		if err := decoder.Decode(&value); err != nil {
+			t.Fatalf("%s: %v", c.input, err)
+		}
+		res, err := Canonical(value)
+		if err != nil {
+			t.Fatalf("%s: %v", c.input, err)
+		}
+		if string(res) != c.expected {
+			t.Errorf("%s serialized as %s, expected %s", c.input, res, c.expected)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package content_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/G1itchZero/ZeroGo/crypt"
+)
+
+type Content map[string]interface{}
+
+// Decode parses a content.json keeping its numbers as written, they are part of the signed data
+func Decode(data []byte) (Content, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	content := Content{}
+	if err := decoder.Decode(&content); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// SignedData returns what the signs are made on: the content without sign and signs
+func (content Content) SignedData() ([]byte, error) {
+	unsigned := map[string]interface{}{}
+	for k, v := range content {
+		if k != "sign" && k != "signs" {
+			unsigned[k] = v
+		}
+	}
+	return Canonical(unsigned)
+}
+
+func (content Content) Modified() float64 {
+	return content.number("modified", 0)
+}
+
+// SignsRequired is the number of valid signs the content needs, 1 unless it tells otherwise
+func (content Content) SignsRequired() int {
+	return int(content.number("signs_required", 1))
+}
+
+func (content Content) number(key string, def float64) float64 {
+	switch v := content[key].(type) {
+	case json.Number:
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+	case float64:
+		return v
+	}
+	return def
+}
+
+// Strings returns a list of strings of the content, nil if there is none
+func (content Content) Strings(key string) []string {
+	return toStrings(content[key])
+}
+
+func toStrings(v interface{}) []string {
+	list, _ := v.([]interface{})
+	var res []string
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// VerifySigns checks the content has the required number of valid signs made by the signers
+func (content Content) VerifySigns(signers []string, required int) error {
+	signs, _ := content["signs"].(map[string]interface{})
+	if len(signs) == 0 {
+		return fmt.Errorf("No signs")
+	}
+	data, err := content.SignedData()
+	if err != nil {
+		return err
+	}
+	valid := 0
+	for _, signer := range signers {
+		sign, ok := signs[signer].(string)
+		if !ok {
+			continue
+		}
+		if crypt.VerifyMessage(data, signer, sign) == nil {
+			valid++
+		}
+	}
+	if valid < required {
+		return fmt.Errorf("Valid signs: %d/%d", valid, required)
+	}
+	return nil
+}
+
+// VerifyRoot checks the root content.json of the site. It has to be signed by the site address,
+// or by the signers it lists when the site address vouched for them with signers_sign.
+func VerifyRoot(site string, data []byte) (Content, error) {
+	content, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := content.checkPath(site, "content.json"); err != nil {
+		return nil, err
+	}
+	if err := content.checkFileNames(); err != nil {
+		return nil, err
+	}
+	signers := content.Strings("signers")
+	if !contains(signers, site) {
+		// the site address is always a valid signer
+		signers = append(signers, site)
+	}
+	if len(signers) > 1 {
+		signersSign, _ := content["signers_sign"].(string)
+		signersData := fmt.Sprintf("%d:%s", content.SignsRequired(), strings.Join(signers, ","))
+		if err := crypt.VerifyMessage([]byte(signersData), site, signersSign); err != nil {
+			return nil, fmt.Errorf("Invalid signers_sign: %v", err)
+		}
+	}
+	if err := content.VerifySigns(signers, content.SignsRequired()); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// reserved names of windows devices, files named so can't be written there
+var windowsDevice = regexp.MustCompile(`(?i)(^|/)(CON|PRN|AUX|NUL|COM[1-9]|LPT[1-9]|CONOUT\$|CONIN\$)(\.|/|$)`)
+
+// IsValidRelativePath tells if a file name of a content.json stays in its directory, like ZeroNet's isValidRelativePath:
+// not absolute, no .. segments, no backslashes, control or other characters filesystems choke on
+func IsValidRelativePath(name string) bool {
+	if name == "" || len(name) > 255 || strings.HasPrefix(name, "/") {
+		return false
+	}
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return false
+		}
+	}
+	if windowsDevice.MatchString(name) {
+		return false
+	}
+	for _, r := range name {
+		if r < 0x20 || strings.ContainsRune("\"*:<>?\\|", r) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkFileNames rejects a content listing files, optional ones or includes out of its directory
+func (content Content) checkFileNames() error {
+	for name := range content.Files() {
+		if !IsValidRelativePath(name) {
+			return fmt.Errorf("Invalid file name: %s", name)
+		}
+	}
+	for name := range content.OptionalFiles() {
+		if !IsValidRelativePath(name) {
+			return fmt.Errorf("Invalid optional file name: %s", name)
+		}
+	}
+	for _, name := range content.Includes() {
+		if !IsValidRelativePath(name) {
+			return fmt.Errorf("Invalid include: %s", name)
+		}
+	}
+	return nil
+}
+
+// checkPath makes sure the content was made for this site and file, so valid signs can't be replayed elsewhere
+func (content Content) checkPath(site string, innerPath string) error {
+	if address, ok := content["address"].(string); ok && address != site {
+		return fmt.Errorf("Wrong site address: %s", address)
+	}
+	if path, ok := content["inner_path"].(string); ok && path != innerPath {
+		return fmt.Errorf("Wrong inner_path: %s", path)
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,134 @@
+package content_manager
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/G1itchZero/ZeroGo/crypt"
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// testdata/content.json is signed by the key of that seed
+const TEST_SITE_SEED = "ZeroGo content_manager test site"
+const TEST_SITE = "1KpwxAeCG7Lm8JysK4jFSK48D9MamXc15D"
+
+func testKey(seed string) (*btcec.PrivateKey, string) {
+	secret := sha256.Sum256([]byte(seed))
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), secret[:])
+	return priv, crypt.PubkeyToAddress(pub.SerializeCompressed())
+}
+
+func sign(priv *btcec.PrivateKey, data []byte) string {
+	sig, _ := btcec.SignCompact(btcec.S256(), priv, crypt.MessageHash(data), true)
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+// signed returns the content as json with the signs of every key
+func signed(t *testing.T, content map[string]interface{}, keys ...*btcec.PrivateKey) []byte {
+	js, _ := json.Marshal(content)
+	decoded, err := Decode(js)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := decoded.SignedData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signs := map[string]interface{}{}
+	for _, priv := range keys {
+		signs[crypt.PubkeyToAddress(priv.PubKey().SerializeCompressed())] = sign(priv, data)
+	}
+	content["signs"] = signs
+	js, _ = json.Marshal(content)
+	return js
+}
+
+func loadTestContent(t *testing.T) []byte {
+	data, err := ioutil.ReadFile("testdata/content.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestVerifyRootSigned(t *testing.T) {
+	if _, site := testKey(TEST_SITE_SEED); site != TEST_SITE {
+		t.Fatalf("test site key gives %s", site)
+	}
+	content, err := VerifyRoot(TEST_SITE, loadTestContent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content.Modified() != 1491574467.435 || len(content.Files()) != 3 || len(content.OptionalFiles()) != 1 {
+		t.Fatalf("unexpected content %v", content)
+	}
+}
+
+func TestVerifyRootRejects(t *testing.T) {
+	data := string(loadTestContent(t))
+	_, other := testKey("someone else")
+	cases := map[string]struct {
+		site string
+		data string
+	}{
+		"tampered title":    {TEST_SITE, strings.Replace(data, `"ZeroGo test"`, `"ZeroGo test!"`, 1)},
+		"tampered modified": {TEST_SITE, strings.Replace(data, "1491574467.435", "1491574467.436", 1)},
+		"tampered unicode":  {TEST_SITE, strings.Replace(data, "Café", "Cafe", 1)},
+		"other site":        {other, strings.Replace(data, TEST_SITE+`",`, other+`",`, 1)},
+		"unsigned":          {TEST_SITE, data[:strings.Index(data, ",\n \"signs\"")] + "\n}"},
+	}
+	for name, c := range cases {
+		if _, err := VerifyRoot(c.site, []byte(c.data)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestVerifyRootSigners(t *testing.T) {
+	sitePriv, site := testKey(TEST_SITE_SEED)
+	otherPriv, other := testKey("co-owner")
+	content := func(required int, vouchedBy *btcec.PrivateKey) map[string]interface{} {
+		return map[string]interface{}{
+			"address":        site,
+			"inner_path":     "content.json",
+			"modified":       1500000000,
+			"files":          map[string]interface{}{},
+			"signers":        []string{other},
+			"signs_required": required,
+			"signers_sign":   sign(vouchedBy, []byte(fmt.Sprintf("%d:%s,%s", required, other, site))),
+		}
+	}
+	if _, err := VerifyRoot(site, signed(t, content(1, sitePriv), otherPriv)); err != nil {
+		t.Fatalf("co-owner sign rejected: %v", err)
+	}
+	if _, err := VerifyRoot(site, signed(t, content(1, otherPriv), otherPriv)); err == nil {
+		t.Fatal("signers_sign of the co-owner itself accepted")
+	}
+	if _, err := VerifyRoot(site, signed(t, content(2, sitePriv), otherPriv)); err == nil {
+		t.Fatal("1 of 2 required signs accepted")
+	}
+	if _, err := VerifyRoot(site, signed(t, content(2, sitePriv), otherPriv, sitePriv)); err != nil {
+		t.Fatalf("2 of 2 required signs rejected: %v", err)
+	}
+}
+
+func TestIsValidRelativePath(t *testing.T) {
+	valid := []string{"index.html", "js/all.js", "data/users/1Abc/data.json", "img/my image.png", "a..b"}
+	invalid := []string{"", "/etc/passwd", "../site/content.json", "css/../../x", "js\\all.js", "index.html.",
+		"index.html ", "con", "data/NUL.txt", "a:b", "a?b", "a\x00b", strings.Repeat("a", 256)}
+	for _, name := range valid {
+		if !IsValidRelativePath(name) {
+			t.Errorf("%q rejected", name)
+		}
+	}
+	for _, name := range invalid {
+		if IsValidRelativePath(name) {
+			t.Errorf("%q accepted", name)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package content_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/G1itchZero/ZeroGo/crypt"
+)
+
+// Rules are what a content.json below the root is allowed to do, from the includes or user_contents of its parent
+type Rules struct {
+	Signers       []string
+	SignsRequired int
+	// bytes of the content.json and its files together, 0 for no limit
+	MaxSize         int64
+	FilesAllowed    string
+	IncludesAllowed bool
+	// the same for files_optional
+	MaxSizeOptional      int64
+	FilesAllowedOptional string
+	// accepted certificate signers by domain
+	CertSigners        map[string][]string
+	CertSignersPattern string
+	UserAddress        string
+}
+
+// ContentManager keeps the verified content.json files of a site, the rules of the nested ones come from them
+type ContentManager struct {
+	Site     string
+	contents map[string]Content
+	sync.Mutex
+}
+
+func NewContentManager(site string) *ContentManager {
+	return &ContentManager{
+		Site:     site,
+		contents: map[string]Content{},
+	}
+}
+
+func (cm *ContentManager) Add(innerPath string, content Content) {
+	cm.Lock()
+	defer cm.Unlock()
+	cm.contents[innerPath] = content
+}
+
+func (cm *ContentManager) Get(innerPath string) Content {
+	cm.Lock()
+	defer cm.Unlock()
+	return cm.contents[innerPath]
+}
+
+// Verify checks a downloaded content.json against the signers and rules it falls under
+func (cm *ContentManager) Verify(innerPath string, data []byte) (Content, error) {
+	if innerPath == "content.json" {
+		return VerifyRoot(cm.Site, data)
+	}
+	content, err := Decode(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := content.checkPath(cm.Site, innerPath); err != nil {
+		return nil, err
+	}
+	if err := content.checkFileNames(); err != nil {
+		return nil, err
+	}
+	rules, err := cm.Rules(innerPath, content)
+	if err != nil {
+		return nil, err
+	}
+	signers := rules.Signers
+	if !contains(signers, cm.Site) {
+		signers = append(signers, cm.Site)
+	}
+	if err := content.VerifySigns(signers, rules.SignsRequired); err != nil {
+		return nil, err
+	}
+	if err := content.verifyCert(rules); err != nil {
+		return nil, err
+	}
+	if err := content.checkRules(rules, int64(len(data))); err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// Rules walks up from the content.json to the closest parent including it or holding user contents
+func (cm *ContentManager) Rules(innerPath string, content Content) (Rules, error) {
+	dirs := strings.Split(innerPath, "/")
+	parts := []string{dirs[len(dirs)-1]}
+	dirs = dirs[:len(dirs)-1]
+	// a content.json can't rule itself
+	if len(dirs) > 0 {
+		parts = append([]string{dirs[len(dirs)-1]}, parts...)
+		dirs = dirs[:len(dirs)-1]
+	}
+	for {
+		parentPath := strings.Trim(strings.Join(dirs, "/")+"/content.json", "/")
+		parent := cm.Get(parentPath)
+		if includes, ok := parent["includes"].(map[string]interface{}); ok {
+			rules, ok := includes[strings.Join(parts, "/")].(map[string]interface{})
+			if !ok {
+				return Rules{}, fmt.Errorf("Not included by %s", parentPath)
+			}
+			return toRules(rules), nil
+		}
+		if _, ok := parent["user_contents"].(map[string]interface{}); ok {
+			return parent.userContentRules(path.Dir(parentPath), innerPath, content)
+		}
+		if len(dirs) == 0 {
+			return Rules{}, fmt.Errorf("No rules for %s", innerPath)
+		}
+		parts = append([]string{dirs[len(dirs)-1]}, parts...)
+		dirs = dirs[:len(dirs)-1]
+	}
+}
+
+// userContentRules merges the permissions of the user with every permission_rules matching its certificate,
+// keeping the larger numbers, the longer strings and all the list items
+func (parent Content) userContentRules(parentDir string, innerPath string, content Content) (Rules, error) {
+	userContents := parent["user_contents"].(map[string]interface{})
+	relative := strings.TrimPrefix(innerPath, strings.TrimPrefix(parentDir+"/", "./"))
+	userAddress := strings.Split(relative, "/")[0]
+	authType, _ := content["cert_auth_type"].(string)
+	certUserID, _ := content["cert_user_id"].(string)
+	if authType == "" || certUserID == "" {
+		authType, certUserID = "n-a", "n-a"
+	}
+	urn := authType + "/" + certUserID
+
+	permissions, _ := userContents["permissions"].(map[string]interface{})
+	permission, ok := permissions[userAddress]
+	if !ok {
+		permission = permissions[certUserID]
+	}
+	banned := permission == false
+	rules := map[string]interface{}{}
+	if dict, ok := permission.(map[string]interface{}); ok {
+		for k, v := range dict {
+			rules[k] = v
+		}
+	}
+	permissionRules, _ := userContents["permission_rules"].(map[string]interface{})
+	for pattern, patternRules := range permissionRules {
+		if matched, err := regexp.MatchString("^(?:"+pattern+")", urn); err != nil || !matched {
+			continue
+		}
+		dict, _ := patternRules.(map[string]interface{})
+		for k, v := range dict {
+			rules[k] = mergeRule(rules[k], v)
+		}
+	}
+	res := toRules(rules)
+	res.CertSigners = map[string][]string{}
+	if certSigners, ok := userContents["cert_signers"].(map[string]interface{}); ok {
+		for domain, addresses := range certSigners {
+			res.CertSigners[domain] = toStrings(addresses)
+		}
+	}
+	res.CertSignersPattern, _ = userContents["cert_signers_pattern"].(string)
+	if !banned {
+		res.Signers = append(res.Signers, userAddress)
+	}
+	res.UserAddress = userAddress
+	res.IncludesAllowed = false
+	return res, nil
+}
+
+func mergeRule(old interface{}, v interface{}) interface{} {
+	if old == nil {
+		return v
+	}
+	switch v := v.(type) {
+	case json.Number:
+		if n, ok := old.(json.Number); ok {
+			a, _ := n.Float64()
+			b, _ := v.Float64()
+			if b > a {
+				return v
+			}
+		}
+	case string:
+		if s, ok := old.(string); ok && len(v) > len(s) {
+			return v
+		}
+	case []interface{}:
+		if list, ok := old.([]interface{}); ok {
+			return append(append([]interface{}{}, list...), v...)
+		}
+	}
+	return old
+}
+
+func toRules(rules map[string]interface{}) Rules {
+	c := Content(rules)
+	res := Rules{
+		Signers:         c.Strings("signers"),
+		SignsRequired:   int(c.number("signers_required", 1)),
+		MaxSize:         int64(c.number("max_size", 0)),
+		MaxSizeOptional: int64(c.number("max_size_optional", 0)),
+		IncludesAllowed: true,
+	}
+	res.FilesAllowed, _ = rules["files_allowed"].(string)
+	res.FilesAllowedOptional, _ = rules["files_allowed_optional"].(string)
+	if allowed, ok := rules["includes_allowed"].(bool); ok {
+		res.IncludesAllowed = allowed
+	}
+	return res
+}
+
+// verifyCert checks the certificate of a user content when the site asks for one
+func (content Content) verifyCert(rules Rules) error {
+	if len(rules.CertSigners) == 0 && rules.CertSignersPattern == "" {
+		return nil
+	}
+	certUserID, _ := content["cert_user_id"].(string)
+	if strings.Count(certUserID, "@") != 1 {
+		return fmt.Errorf("Invalid cert_user_id: %s", certUserID)
+	}
+	parts := strings.SplitN(certUserID, "@", 2)
+	name, domain := parts[0], parts[1]
+	signers, ok := rules.CertSigners[domain]
+	if !ok {
+		matched := false
+		if rules.CertSignersPattern != "" {
+			matched, _ = regexp.MatchString("^(?:"+rules.CertSignersPattern+")", domain)
+		}
+		if !matched {
+			return fmt.Errorf("Invalid cert signer: %s", domain)
+		}
+		signers = []string{domain}
+	}
+	authType, _ := content["cert_auth_type"].(string)
+	sign, _ := content["cert_sign"].(string)
+	data := []byte(fmt.Sprintf("%s#%s/%s", rules.UserAddress, authType, name))
+	for _, signer := range signers {
+		if crypt.VerifyMessage(data, signer, sign) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("Invalid cert of %s", certUserID)
+}
+
+// checkRules enforces the size, file names and includes the rules allow
+func (content Content) checkRules(rules Rules, size int64) error {
+	if err := checkFiles(content.Files(), size, rules.MaxSize, rules.FilesAllowed); err != nil {
+		return err
+	}
+	if err := checkFiles(content.OptionalFiles(), 0, rules.MaxSizeOptional, rules.FilesAllowedOptional); err != nil {
+		return fmt.Errorf("Optional: %v", err)
+	}
+	if _, ok := content["includes"]; ok && !rules.IncludesAllowed {
+		return fmt.Errorf("Includes not allowed")
+	}
+	return nil
+}
+
+func checkFiles(files map[string]File, size int64, maxSize int64, filesAllowed string) error {
+	for _, file := range files {
+		if file.Size > 0 {
+			size += file.Size
+		}
+	}
+	if maxSize > 0 && size > maxSize {
+		return fmt.Errorf("Include too large %dB > %dB", size, maxSize)
+	}
+	if filesAllowed != "" {
+		allowed, err := regexp.Compile("^(?:" + filesAllowed + ")$")
+		if err != nil {
+			return fmt.Errorf("Bad files_allowed: %v", err)
+		}
+		for name := range files {
+			if !allowed.MatchString(name) {
+				return fmt.Errorf("File not allowed: %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+type File struct {
+	Sha512 string
+	Size   int64
+}
+
+// Files returns the files listed by the content, by path relative to its directory
+func (content Content) Files() map[string]File {
+	return content.fileList("files")
+}
+
+// OptionalFiles returns the files_optional of the content, they are only downloaded on request
+func (content Content) OptionalFiles() map[string]File {
+	return content.fileList("files_optional")
+}
+
+func (content Content) fileList(key string) map[string]File {
+	res := map[string]File{}
+	files, _ := content[key].(map[string]interface{})
+	for name, info := range files {
+		dict, _ := info.(map[string]interface{})
+		file := Content(dict)
+		sha512, _ := dict["sha512"].(string)
+		res[name] = File{sha512, int64(file.number("size", 0))}
+	}
+	return res
+}
+
+// Includes returns the content.json files the content includes, relative to its directory
+func (content Content) Includes() []string {
+	includes, _ := content["includes"].(map[string]interface{})
+	res := []string{}
+	for name := range includes {
+		res = append(res, name)
+	}
+	return res
+}
+
+// HasUserContents tells if the directories next to the content hold user content.json files
+func (content Content) HasUserContents() bool {
+	_, ok := content["user_contents"].(map[string]interface{})
+	return ok
+}
+
+// IsArchived tells if a user content.json of that modified was deleted by the site,
+// through archived of its directory or archived_before of every user
+func (cm *ContentManager) IsArchived(innerPath string, modified float64) bool {
+	userDir := path.Dir(innerPath)
+	parentPath := path.Join(path.Dir(userDir), "content.json")
+	if parentPath == innerPath {
+		return false
+	}
+	userContents, ok := cm.Get(parentPath)["user_contents"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	uc := Content(userContents)
+	if before := uc.number("archived_before", 0); before > 0 && modified <= before {
+		return true
+	}
+	archived, _ := userContents["archived"].(map[string]interface{})
+	if at := Content(archived).number(path.Base(userDir), 0); at > 0 && modified <= at {
+		return true
+	}
+	return false
+}
@@ -0,0 +1,125 @@
+package content_manager
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+// newTestManager holds the signed root of testdata and a data/users/content.json with user_contents rules
+func newTestManager(t *testing.T) (*ContentManager, *btcec.PrivateKey) {
+	sitePriv, site := testKey(TEST_SITE_SEED)
+	_, certSigner := testKey("zeroid.bit")
+	_, banned := testKey("banned user")
+	cm := NewContentManager(site)
+	root, err := cm.Verify("content.json", loadTestContent(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Add("content.json", root)
+	users, err := cm.Verify("data/users/content.json", signed(t, map[string]interface{}{
+		"address":    site,
+		"inner_path": "data/users/content.json",
+		"modified":   1500000000,
+		"files":      map[string]interface{}{},
+		"user_contents": map[string]interface{}{
+			"cert_signers": map[string]interface{}{"zeroid.bit": []string{certSigner}},
+			"permission_rules": map[string]interface{}{
+				".*":         map[string]interface{}{"files_allowed": "data.json", "max_size": 10000},
+				"web/vip@.*": map[string]interface{}{"max_size": 100000},
+			},
+			"permissions": map[string]interface{}{"troll@zeroid.bit": false, banned: false},
+		},
+	}, sitePriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cm.Add("data/users/content.json", users)
+	return cm, sitePriv
+}
+
+// userContent is the content.json of the user of that seed, with a zeroid.bit certificate for name
+func userContent(t *testing.T, seed string, name string, files map[string]interface{}) (string, []byte) {
+	userPriv, user := testKey(seed)
+	certPriv, _ := testKey("zeroid.bit")
+	innerPath := "data/users/" + user + "/content.json"
+	return innerPath, signed(t, map[string]interface{}{
+		"inner_path":     innerPath,
+		"modified":       1500000001,
+		"files":          files,
+		"cert_auth_type": "web",
+		"cert_user_id":   name + "@zeroid.bit",
+		"cert_sign":      sign(certPriv, []byte(user+"#web/"+name)),
+	}, userPriv)
+}
+
+func dataFile(size int) map[string]interface{} {
+	return map[string]interface{}{"data.json": map[string]interface{}{"sha512": "0f1e2d3c", "size": size}}
+}
+
+func TestUserContentRules(t *testing.T) {
+	cm, _ := newTestManager(t)
+	cases := []struct {
+		name   string
+		seed   string
+		cert   string
+		files  map[string]interface{}
+		accept bool
+	}{
+		{"allowed file", "user", "joe", dataFile(100), true},
+		{"file not allowed", "user", "joe", map[string]interface{}{"evil.js": map[string]interface{}{"sha512": "0f1e2d3c", "size": 10}}, false},
+		{"over max_size", "user", "joe", dataFile(20000), false},
+		{"larger max_size of a matching rule", "user", "vip", dataFile(20000), true},
+		{"banned cert user", "user", "troll", dataFile(100), false},
+		{"banned address", "banned user", "joe", dataFile(100), false},
+	}
+	for _, c := range cases {
+		innerPath, data := userContent(t, c.seed, c.cert, c.files)
+		_, err := cm.Verify(innerPath, data)
+		if c.accept && err != nil {
+			t.Errorf("%s: rejected: %v", c.name, err)
+		}
+		if !c.accept && err == nil {
+			t.Errorf("%s: accepted", c.name)
+		}
+	}
+}
+
+func TestUserContentCertSigners(t *testing.T) {
+	cm, _ := newTestManager(t)
+	userPriv, user := testKey("user")
+	innerPath := "data/users/" + user + "/content.json"
+	content := func(certUserID string, certBy *btcec.PrivateKey) []byte {
+		return signed(t, map[string]interface{}{
+			"inner_path":     innerPath,
+			"modified":       1500000001,
+			"files":          dataFile(100),
+			"cert_auth_type": "web",
+			"cert_user_id":   certUserID,
+			"cert_sign":      sign(certBy, []byte(user+"#web/joe")),
+		}, userPriv)
+	}
+	certPriv, _ := testKey("zeroid.bit")
+	if _, err := cm.Verify(innerPath, content("joe@zeroid.bit", certPriv)); err != nil {
+		t.Fatalf("valid cert rejected: %v", err)
+	}
+	if _, err := cm.Verify(innerPath, content("joe@zeroid.bit", userPriv)); err == nil {
+		t.Fatal("cert signed by the user itself accepted")
+	}
+	if _, err := cm.Verify(innerPath, content("joe@other.bit", certPriv)); err == nil {
+		t.Fatal("cert of an unknown signer domain accepted")
+	}
+}
+
+func TestNotIncluded(t *testing.T) {
+	cm, sitePriv := newTestManager(t)
+	data := signed(t, map[string]interface{}{
+		"address":    cm.Site,
+		"inner_path": "data/other/content.json",
+		"modified":   1500000000,
+		"files":      map[string]interface{}{},
+	}, sitePriv)
+	if _, err := cm.Verify("data/other/content.json", data); err == nil {
+		t.Fatal("content.json no include lists accepted")
+	}
+}
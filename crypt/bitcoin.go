@@ -0,0 +1,98 @@
+package crypt
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+
+	"github.com/btcsuite/btcd/btcec"
+	"golang.org/x/crypto/ripemd160"
+)
+
+const MESSAGE_MAGIC = "Bitcoin Signed Message:\n"
+
+const BASE58_ALPHABET = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// MessageHash is the double sha256 Bitcoin signs messages with
+func MessageHash(message []byte) []byte {
+	buf := bytes.Buffer{}
+	writeVarString(&buf, []byte(MESSAGE_MAGIC))
+	writeVarString(&buf, message)
+	first := sha256.Sum256(buf.Bytes())
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+func writeVarString(buf *bytes.Buffer, s []byte) {
+	n := len(s)
+	switch {
+	case n < 0xfd:
+		buf.WriteByte(byte(n))
+	case n <= 0xffff:
+		buf.Write([]byte{0xfd, byte(n), byte(n >> 8)})
+	default:
+		buf.Write([]byte{0xfe, byte(n), byte(n >> 8), byte(n >> 16), byte(n >> 24)})
+	}
+	buf.Write(s)
+}
+
+// VerifyMessage checks a base64 Bitcoin message signature, like the ones of content.json, against the address
+func VerifyMessage(message []byte, address string, signature string) error {
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("Bad signature encoding: %v", err)
+	}
+	if len(sig) != 65 {
+		return fmt.Errorf("Bad signature length: %d", len(sig))
+	}
+	pub, compressed, err := btcec.RecoverCompact(btcec.S256(), sig, MessageHash(message))
+	if err != nil {
+		return fmt.Errorf("Bad signature: %v", err)
+	}
+	var key []byte
+	if compressed {
+		key = pub.SerializeCompressed()
+	} else {
+		key = pub.SerializeUncompressed()
+	}
+	if signer := PubkeyToAddress(key); signer != address {
+		return fmt.Errorf("Signed by %s instead of %s", signer, address)
+	}
+	return nil
+}
+
+// PubkeyToAddress returns the Bitcoin address of a serialized public key
+func PubkeyToAddress(key []byte) string {
+	hash := sha256.Sum256(key)
+	h := ripemd160.New()
+	h.Write(hash[:])
+	return base58Check(0, h.Sum(nil))
+}
+
+func base58Check(version byte, payload []byte) string {
+	data := append([]byte{version}, payload...)
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	data = append(data, second[:4]...)
+	n := new(big.Int).SetBytes(data)
+	base := big.NewInt(58)
+	mod := new(big.Int)
+	res := []byte{}
+	for n.Sign() > 0 {
+		n.DivMod(n, base, mod)
+		res = append(res, BASE58_ALPHABET[mod.Int64()])
+	}
+	// every leading zero byte is a leading 1
+	for _, b := range data {
+		if b != 0 {
+			break
+		}
+		res = append(res, BASE58_ALPHABET[0])
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return string(res)
+}
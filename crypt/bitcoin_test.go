@@ -0,0 +1,60 @@
+package crypt
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestPubkeyToAddress(t *testing.T) {
+	// the well known addresses of private key 1
+	_, pub := btcec.PrivKeyFromBytes(btcec.S256(), big.NewInt(1).Bytes())
+	if address := PubkeyToAddress(pub.SerializeUncompressed()); address != "1EHNa6Q4Jz2uvNExL497mE43ikXhwF6kZm" {
+		t.Errorf("uncompressed key gives %s", address)
+	}
+	if address := PubkeyToAddress(pub.SerializeCompressed()); address != "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH" {
+		t.Errorf("compressed key gives %s", address)
+	}
+}
+
+func TestMessageHash(t *testing.T) {
+	// sha256(sha256("\x18Bitcoin Signed Message:\n\x05hello"))
+	if hash := fmt.Sprintf("%x", MessageHash([]byte("hello"))); hash != "cf0447ec85f0ce7150a257db32ebfcb7523dae17c36dbd1be598779fec0484f4" {
+		t.Errorf("got %s", hash)
+	}
+}
+
+func TestVerifyMessage(t *testing.T) {
+	priv, pub := btcec.PrivKeyFromBytes(btcec.S256(), big.NewInt(1234).Bytes())
+	message := []byte("1:1Signer,1Site")
+	for _, compressed := range []bool{true, false} {
+		key := pub.SerializeUncompressed()
+		if compressed {
+			key = pub.SerializeCompressed()
+		}
+		address := PubkeyToAddress(key)
+		sig, err := btcec.SignCompact(btcec.S256(), priv, MessageHash(message), compressed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := base64.StdEncoding.EncodeToString(sig)
+		if err := VerifyMessage(message, address, signature); err != nil {
+			t.Errorf("compressed %v: %v", compressed, err)
+		}
+		if err := VerifyMessage([]byte("2:1Signer,1Site"), address, signature); err == nil {
+			t.Errorf("compressed %v: sign of another message accepted", compressed)
+		}
+		if err := VerifyMessage(message, "1EHNa6Q4Jz2uvNExL497mE43ikXhwF6kZm", signature); err == nil {
+			t.Errorf("compressed %v: sign accepted for another address", compressed)
+		}
+	}
+	if err := VerifyMessage(message, "1EHNa6Q4Jz2uvNExL497mE43ikXhwF6kZm", "not base64!"); err == nil {
+		t.Error("bad encoding accepted")
+	}
+	if err := VerifyMessage(message, "1EHNa6Q4Jz2uvNExL497mE43ikXhwF6kZm", base64.StdEncoding.EncodeToString(make([]byte, 64))); err == nil {
+		t.Error("short signature accepted")
+	}
+}
@@ -0,0 +1,420 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// contacts per bucket and results kept by lookups
+const K = 8
+
+// queries in flight per lookup step
+const ALPHA = 3
+
+const QUERY_TIMEOUT = 5 * time.Second
+
+// contacts not heard from for that long can be replaced
+const NODE_STALE = 15 * time.Minute
+
+// unanswered queries before a contact is dropped
+const MAX_FAILS = 2
+
+// announce_peer tokens are valid for up to two rotations
+const TOKEN_ROTATE = 5 * time.Minute
+
+// announced peers are forgotten after that long
+const PEER_TTL = 30 * time.Minute
+
+// max peers returned in get_peers answers
+const MAX_VALUES = 50
+
+const SAVE_INTERVAL = 5 * time.Minute
+
+const FILENAME = "dht.json"
+
+var BOOTSTRAP_NODES = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+var ErrTimeout = errors.New("DHT query timed out")
+
+type message map[string]interface{}
+
+// Node is a BEP 5 DHT node: it answers queries and finds and announces peers of info hashes
+type Node struct {
+	ID         ID
+	Conn       *net.UDPConn
+	Table      *Table
+	filename   string
+	peers      map[ID]map[string]time.Time
+	pending    map[string]chan message
+	tid        uint16
+	secret     []byte
+	prevSecret []byte
+	rotated    time.Time
+	done       chan struct{}
+	sync.Mutex
+}
+
+var node *Node
+
+// GetNode returns the running node, nil if the DHT is disabled
+func GetNode() *Node {
+	return node
+}
+
+// Start runs the process wide node on the udp port and joins the network through the bootstrap nodes
+func Start(port int, filename string, bootstrap []string) (*Node, error) {
+	n, err := NewNode(port, filename)
+	if err != nil {
+		return nil, err
+	}
+	node = n
+	go n.Serve()
+	go n.Bootstrap(bootstrap)
+	go n.saveLoop()
+	return n, nil
+}
+
+// NewNode listens on the udp port, restoring the id and routing table saved in filename if any
+func NewNode(port int, filename string) (*Node, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		ID:       RandomID(),
+		Conn:     conn,
+		filename: filename,
+		peers:    map[ID]map[string]time.Time{},
+		pending:  map[string]chan message{},
+		secret:   randomBytes(8),
+		rotated:  time.Now(),
+		done:     make(chan struct{}),
+	}
+	n.prevSecret = n.secret
+	n.Table = NewTable(n.ID)
+	if filename != "" {
+		if err := n.load(); err != nil && !os.IsNotExist(err) {
+			log.WithFields(log.Fields{
+				"file": filename,
+				"err":  err,
+			}).Warn("Can't load DHT table")
+		}
+	}
+	return n, nil
+}
+
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+type savedContact struct {
+	ID   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+type savedNode struct {
+	ID    string         `json:"id"`
+	Nodes []savedContact `json:"nodes"`
+}
+
+func (n *Node) load() error {
+	content, err := ioutil.ReadFile(n.filename)
+	if err != nil {
+		return err
+	}
+	saved := savedNode{}
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return err
+	}
+	if id, err := hex.DecodeString(saved.ID); err == nil && len(id) == 20 {
+		copy(n.ID[:], id)
+		n.Table = NewTable(n.ID)
+	}
+	for _, s := range saved.Nodes {
+		id, err := hex.DecodeString(s.ID)
+		addr, err2 := net.ResolveUDPAddr("udp4", s.Addr)
+		if err != nil || err2 != nil || len(id) != 20 {
+			continue
+		}
+		c := ID{}
+		copy(c[:], id)
+		n.Table.Insert(c, addr)
+	}
+	return nil
+}
+
+// Save writes our id and the routing table, so the next run doesn't start from scratch
+func (n *Node) Save() error {
+	if n.filename == "" {
+		return nil
+	}
+	saved := savedNode{ID: n.ID.String()}
+	for _, c := range n.Table.Contacts() {
+		saved.Nodes = append(saved.Nodes, savedContact{c.ID.String(), c.Addr.String()})
+	}
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(n.filename, content, 0644)
+}
+
+func (n *Node) saveLoop() {
+	ticker := time.NewTicker(SAVE_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.Save()
+		}
+	}
+}
+
+func (n *Node) Stop() {
+	n.Lock()
+	select {
+	case <-n.done:
+		n.Unlock()
+		return
+	default:
+	}
+	close(n.done)
+	n.Unlock()
+	n.Save()
+	n.Conn.Close()
+}
+
+func (n *Node) Addr() *net.UDPAddr {
+	return n.Conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Serve reads messages until the node is stopped
+func (n *Node) Serve() {
+	buf := make([]byte, 65536)
+	for {
+		size, addr, err := n.Conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+			}
+			continue
+		}
+		raw, err := bencode.Decode(bytes.NewReader(buf[:size]))
+		if err != nil {
+			continue
+		}
+		msg, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		n.handle(message(msg), addr)
+	}
+}
+
+func (n *Node) handle(msg message, addr *net.UDPAddr) {
+	tid, _ := msg["t"].(string)
+	switch msg["y"] {
+	case "q":
+		n.handleQuery(msg, tid, addr)
+	case "r", "e":
+		n.Lock()
+		ch, ok := n.pending[tid]
+		delete(n.pending, tid)
+		n.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+func (n *Node) send(msg message, addr *net.UDPAddr) error {
+	buf := bytes.Buffer{}
+	if err := bencode.Marshal(&buf, map[string]interface{}(msg)); err != nil {
+		return err
+	}
+	_, err := n.Conn.WriteToUDP(buf.Bytes(), addr)
+	return err
+}
+
+func (n *Node) respond(tid string, r message, addr *net.UDPAddr) {
+	r["id"] = string(n.ID[:])
+	n.send(message{"t": tid, "y": "r", "r": map[string]interface{}(r)}, addr)
+}
+
+func (n *Node) respondError(tid string, code int, text string, addr *net.UDPAddr) {
+	n.send(message{"t": tid, "y": "e", "e": []interface{}{code, text}}, addr)
+}
+
+func (n *Node) handleQuery(msg message, tid string, addr *net.UDPAddr) {
+	args, _ := msg["a"].(map[string]interface{})
+	id, ok := toID(args["id"])
+	if !ok {
+		n.respondError(tid, 203, "Bad id", addr)
+		return
+	}
+	n.Table.Insert(id, addr)
+	switch msg["q"] {
+	case "ping":
+		n.respond(tid, message{}, addr)
+	case "find_node":
+		target, ok := toID(args["target"])
+		if !ok {
+			n.respondError(tid, 203, "Bad target", addr)
+			return
+		}
+		n.respond(tid, message{"nodes": packNodes(n.Table.Closest(target, K))}, addr)
+	case "get_peers":
+		infoHash, ok := toID(args["info_hash"])
+		if !ok {
+			n.respondError(tid, 203, "Bad info_hash", addr)
+			return
+		}
+		secret, _ := n.secrets()
+		r := message{"token": token(addr.IP, secret)}
+		if values := n.storedPeers(infoHash); len(values) > 0 {
+			r["values"] = values
+		} else {
+			r["nodes"] = packNodes(n.Table.Closest(infoHash, K))
+		}
+		n.respond(tid, r, addr)
+	case "announce_peer":
+		infoHash, ok := toID(args["info_hash"])
+		t, _ := args["token"].(string)
+		if !ok || !n.validToken(t, addr.IP) {
+			n.respondError(tid, 203, "Bad token", addr)
+			return
+		}
+		port, _ := args["port"].(int64)
+		if implied, _ := args["implied_port"].(int64); implied != 0 {
+			port = int64(addr.Port)
+		}
+		if port <= 0 || port > 65535 {
+			n.respondError(tid, 203, "Bad port", addr)
+			return
+		}
+		n.storePeer(infoHash, &net.UDPAddr{IP: addr.IP, Port: int(port)})
+		n.respond(tid, message{}, addr)
+	default:
+		n.respondError(tid, 204, "Method Unknown", addr)
+	}
+}
+
+func toID(v interface{}) (ID, bool) {
+	s, ok := v.(string)
+	id := ID{}
+	if !ok || len(s) != 20 {
+		return id, false
+	}
+	copy(id[:], s)
+	return id, true
+}
+
+// secrets returns the current and previous token secrets, rotating them when due
+func (n *Node) secrets() ([]byte, []byte) {
+	n.Lock()
+	defer n.Unlock()
+	if time.Since(n.rotated) > TOKEN_ROTATE {
+		n.prevSecret = n.secret
+		n.secret = randomBytes(8)
+		n.rotated = time.Now()
+	}
+	return n.secret, n.prevSecret
+}
+
+// token is handed out in get_peers and has to come back in announce_peer from the same ip
+func token(ip net.IP, secret []byte) string {
+	hash := sha1.Sum(append(append([]byte{}, secret...), ip.To4()...))
+	return string(hash[:8])
+}
+
+func (n *Node) validToken(t string, ip net.IP) bool {
+	secret, prev := n.secrets()
+	return t == token(ip, secret) || t == token(ip, prev)
+}
+
+func (n *Node) storePeer(infoHash ID, addr *net.UDPAddr) {
+	n.Lock()
+	defer n.Unlock()
+	if n.peers[infoHash] == nil {
+		n.peers[infoHash] = map[string]time.Time{}
+	}
+	n.peers[infoHash][string(packAddr(addr))] = time.Now()
+}
+
+// storedPeers returns compact addresses of the peers announced for the hash
+func (n *Node) storedPeers(infoHash ID) []interface{} {
+	n.Lock()
+	defer n.Unlock()
+	values := []interface{}{}
+	for packed, seen := range n.peers[infoHash] {
+		if time.Since(seen) > PEER_TTL {
+			delete(n.peers[infoHash], packed)
+			continue
+		}
+		if len(values) < MAX_VALUES {
+			values = append(values, packed)
+		}
+	}
+	return values
+}
+
+// query sends a query and waits for its answer
+func (n *Node) query(addr *net.UDPAddr, q string, args message) (message, error) {
+	n.Lock()
+	n.tid++
+	tid := string([]byte{byte(n.tid >> 8), byte(n.tid)})
+	ch := make(chan message, 1)
+	n.pending[tid] = ch
+	n.Unlock()
+	args["id"] = string(n.ID[:])
+	err := n.send(message{"t": tid, "y": "q", "q": q, "a": map[string]interface{}(args)}, addr)
+	if err == nil {
+		select {
+		case msg := <-ch:
+			if msg["y"] == "e" {
+				return nil, fmt.Errorf("DHT error: %v", msg["e"])
+			}
+			r, _ := msg["r"].(map[string]interface{})
+			if id, ok := toID(r["id"]); ok {
+				n.Table.Insert(id, addr)
+			}
+			return message(r), nil
+		case <-time.After(QUERY_TIMEOUT):
+			err = ErrTimeout
+		case <-n.done:
+			err = ErrTimeout
+		}
+	}
+	n.Lock()
+	delete(n.pending, tid)
+	n.Unlock()
+	return nil, err
+}
+
+func (n *Node) Ping(addr *net.UDPAddr) error {
+	_, err := n.query(addr, "ping", message{})
+	return err
+}
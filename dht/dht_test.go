@@ -0,0 +1,106 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// startNodes runs count nodes on localhost, all bootstrapped from the first one
+func startNodes(t *testing.T, dir string, count int) []*Node {
+	nodes := []*Node{}
+	for i := 0; i < count; i++ {
+		n, err := NewNode(0, path.Join(dir, fmt.Sprintf("node%d.json", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		go n.Serve()
+		nodes = append(nodes, n)
+	}
+	boot := fmt.Sprintf("127.0.0.1:%d", nodes[0].Addr().Port)
+	for _, n := range nodes[1:] {
+		n.Bootstrap([]string{boot})
+	}
+	return nodes
+}
+
+func stopNodes(nodes []*Node) {
+	for _, n := range nodes {
+		n.Stop()
+	}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "dht")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestAnnounceThenGetPeers(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	nodes := startNodes(t, dir, 8)
+	defer stopNodes(nodes)
+
+	infoHash := ID(sha1.Sum([]byte("1HeLLo4uzjaLetFx6NH3PMwFP3qbRbTf3D")))
+	if peers := nodes[7].GetPeers(infoHash); len(peers) != 0 {
+		t.Fatalf("peers before any announce: %v", peers)
+	}
+	nodes[3].Announce(infoHash, 15441)
+	// announce_peer queries are sent in the background
+	var peers []*net.UDPAddr
+	for i := 0; i < 20 && len(peers) == 0; i++ {
+		time.Sleep(50 * time.Millisecond)
+		peers = nodes[7].GetPeers(infoHash)
+	}
+	if len(peers) != 1 || peers[0].Port != 15441 || !peers[0].IP.IsLoopback() {
+		t.Fatalf("expected the announced peer, got %v", peers)
+	}
+}
+
+func TestAnnounceNeedsToken(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	nodes := startNodes(t, dir, 2)
+	defer stopNodes(nodes)
+
+	infoHash := ID(sha1.Sum([]byte("1HeLLo4uzjaLetFx6NH3PMwFP3qbRbTf3D")))
+	_, err := nodes[1].query(nodes[0].Addr(), "announce_peer", message{
+		"info_hash": string(infoHash[:]),
+		"port":      15441,
+		"token":     "forged",
+	})
+	if err == nil {
+		t.Fatal("announce with a forged token accepted")
+	}
+	if peers := nodes[0].storedPeers(infoHash); len(peers) != 0 {
+		t.Fatalf("peer stored without a valid token: %v", peers)
+	}
+}
+
+func TestTablePersisted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	nodes := startNodes(t, dir, 4)
+	stopNodes(nodes)
+
+	last := nodes[len(nodes)-1]
+	reloaded, err := NewNode(0, path.Join(dir, fmt.Sprintf("node%d.json", len(nodes)-1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reloaded.Stop()
+	if reloaded.ID != last.ID {
+		t.Fatalf("id %s reloaded as %s", last.ID, reloaded.ID)
+	}
+	if reloaded.Table.Len() == 0 || reloaded.Table.Len() != last.Table.Len() {
+		t.Fatalf("%d contacts reloaded, %d saved", reloaded.Table.Len(), last.Table.Len())
+	}
+}
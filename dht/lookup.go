@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// max rounds of a lookup, it normally converges much earlier
+const MAX_LOOKUP_ROUNDS = 20
+
+type candidate struct {
+	Contact
+	queried bool
+	token   string
+}
+
+// lookup walks towards the target asking the closest known nodes for closer ones.
+// With getPeers it uses get_peers and also collects the peers and announce tokens found on the way.
+func (n *Node) lookup(target ID, getPeers bool) ([]candidate, []*net.UDPAddr) {
+	candidates := []*candidate{}
+	seen := map[ID]bool{}
+	add := func(c Contact) {
+		if seen[c.ID] || c.ID == n.ID {
+			return
+		}
+		seen[c.ID] = true
+		candidates = append(candidates, &candidate{Contact: c})
+	}
+	for _, c := range n.Table.Closest(target, K) {
+		add(c)
+	}
+	peers := []*net.UDPAddr{}
+	peersSeen := map[string]bool{}
+	var lock sync.Mutex
+	for round := 0; round < MAX_LOOKUP_ROUNDS; round++ {
+		sort.Slice(candidates, func(i, j int) bool {
+			return target.closer(candidates[i].ID, candidates[j].ID)
+		})
+		if len(candidates) > K*2 {
+			candidates = candidates[:K*2]
+		}
+		batch := []*candidate{}
+		for _, c := range candidates[:min(K, len(candidates))] {
+			if !c.queried && len(batch) < ALPHA {
+				c.queried = true
+				batch = append(batch, c)
+			}
+		}
+		if len(batch) == 0 {
+			break
+		}
+		var wg sync.WaitGroup
+		found := []Contact{}
+		for _, c := range batch {
+			wg.Add(1)
+			go func(c *candidate) {
+				defer wg.Done()
+				var r message
+				var err error
+				if getPeers {
+					r, err = n.query(c.Addr, "get_peers", message{"info_hash": string(target[:])})
+				} else {
+					r, err = n.query(c.Addr, "find_node", message{"target": string(target[:])})
+				}
+				if err != nil {
+					n.Table.Failed(c.ID)
+					return
+				}
+				nodes, _ := r["nodes"].(string)
+				lock.Lock()
+				defer lock.Unlock()
+				c.token, _ = r["token"].(string)
+				found = append(found, unpackNodes(nodes)...)
+				values, _ := r["values"].([]interface{})
+				for _, v := range values {
+					packed, ok := v.(string)
+					if !ok || len(packed) != 6 || peersSeen[packed] {
+						continue
+					}
+					peersSeen[packed] = true
+					peers = append(peers, unpackAddr([]byte(packed)))
+				}
+			}(c)
+		}
+		wg.Wait()
+		for _, c := range found {
+			if c.Addr.Port != 0 {
+				add(c)
+			}
+		}
+	}
+	closest := []candidate{}
+	for _, c := range candidates {
+		if c.queried && len(closest) < K {
+			closest = append(closest, *c)
+		}
+	}
+	return closest, peers
+}
+
+func min(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Bootstrap joins the network: it asks the given nodes, and the saved ones, for the nodes closest to us
+func (n *Node) Bootstrap(addresses []string) {
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		addr, err := net.ResolveUDPAddr("udp4", address)
+		if err != nil {
+			continue
+		}
+		wg.Add(1)
+		go func(addr *net.UDPAddr) {
+			defer wg.Done()
+			r, err := n.query(addr, "find_node", message{"target": string(n.ID[:])})
+			if err != nil {
+				return
+			}
+			nodes, _ := r["nodes"].(string)
+			for _, c := range unpackNodes(nodes) {
+				n.Table.Insert(c.ID, c.Addr)
+			}
+		}(addr)
+	}
+	wg.Wait()
+	n.lookup(n.ID, false)
+	log.WithFields(log.Fields{
+		"nodes": n.Table.Len(),
+	}).Debug("DHT bootstrapped")
+}
+
+// GetPeers returns the peers the network knows for the info hash
+func (n *Node) GetPeers(infoHash ID) []*net.UDPAddr {
+	_, peers := n.lookup(infoHash, true)
+	return peers
+}
+
+// Announce finds the peers of the info hash and tells the closest nodes we have it on the tcp port
+func (n *Node) Announce(infoHash ID, port int) []*net.UDPAddr {
+	closest, peers := n.lookup(infoHash, true)
+	for _, c := range closest {
+		if c.token == "" {
+			continue
+		}
+		go n.query(c.Addr, "announce_peer", message{
+			"info_hash":    string(infoHash[:]),
+			"port":         port,
+			"token":        c.token,
+			"implied_port": 0,
+		})
+	}
+	return peers
+}
@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ID identifies nodes and info hashes alike
+type ID [20]byte
+
+func RandomID() ID {
+	id := ID{}
+	rand.Read(id[:])
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// closer tells if a is closer to the target than b by xor distance
+func (target ID) closer(a ID, b ID) bool {
+	for i := range target {
+		da, db := a[i]^target[i], b[i]^target[i]
+		if da != db {
+			return da < db
+		}
+	}
+	return false
+}
+
+// bucketIndex returns the length of the common prefix of both ids
+func (id ID) bucketIndex(other ID) int {
+	for i := range id {
+		x := id[i] ^ other[i]
+		if x == 0 {
+			continue
+		}
+		n := 0
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return i*8 + n
+	}
+	return len(id)*8 - 1
+}
+
+type Contact struct {
+	ID       ID
+	Addr     *net.UDPAddr
+	LastSeen time.Time
+	fails    int
+}
+
+// Table is the kademlia routing table, K contacts per bucket
+type Table struct {
+	self    ID
+	buckets [160][]*Contact
+	sync.Mutex
+}
+
+func NewTable(self ID) *Table {
+	return &Table{self: self}
+}
+
+// Insert adds or refreshes a contact, full buckets only make room by dropping stale ones
+func (t *Table) Insert(id ID, addr *net.UDPAddr) {
+	if id == t.self || addr.IP.To4() == nil || addr.Port == 0 {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	i := t.self.bucketIndex(id)
+	bucket := t.buckets[i]
+	for _, c := range bucket {
+		if c.ID == id {
+			c.Addr = addr
+			c.LastSeen = time.Now()
+			c.fails = 0
+			return
+		}
+	}
+	c := &Contact{ID: id, Addr: addr, LastSeen: time.Now()}
+	if len(bucket) < K {
+		t.buckets[i] = append(bucket, c)
+		return
+	}
+	oldest := 0
+	for j, b := range bucket {
+		if b.LastSeen.Before(bucket[oldest].LastSeen) {
+			oldest = j
+		}
+	}
+	if time.Since(bucket[oldest].LastSeen) > NODE_STALE {
+		bucket[oldest] = c
+	}
+}
+
+// Failed counts an unanswered query, contacts failing too often are dropped
+func (t *Table) Failed(id ID) {
+	t.Lock()
+	defer t.Unlock()
+	i := t.self.bucketIndex(id)
+	for j, c := range t.buckets[i] {
+		if c.ID == id {
+			c.fails++
+			if c.fails >= MAX_FAILS {
+				t.buckets[i] = append(t.buckets[i][:j], t.buckets[i][j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// Closest returns up to n contacts closest to the target
+func (t *Table) Closest(target ID, n int) []Contact {
+	contacts := t.Contacts()
+	sort.Slice(contacts, func(i, j int) bool {
+		return target.closer(contacts[i].ID, contacts[j].ID)
+	})
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func (t *Table) Contacts() []Contact {
+	t.Lock()
+	defer t.Unlock()
+	contacts := []Contact{}
+	for _, bucket := range t.buckets {
+		for _, c := range bucket {
+			contacts = append(contacts, *c)
+		}
+	}
+	return contacts
+}
+
+func (t *Table) Len() int {
+	t.Lock()
+	defer t.Unlock()
+	n := 0
+	for _, bucket := range t.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+// packNodes encodes contacts as compact node info: id, ip and big endian port
+func packNodes(contacts []Contact) string {
+	buf := bytes.Buffer{}
+	for _, c := range contacts {
+		buf.Write(c.ID[:])
+		buf.Write(packAddr(c.Addr))
+	}
+	return buf.String()
+}
+
+func unpackNodes(data string) []Contact {
+	contacts := []Contact{}
+	for i := 0; i+26 <= len(data); i += 26 {
+		c := Contact{}
+		copy(c.ID[:], data[i:i+20])
+		c.Addr = unpackAddr([]byte(data[i+20 : i+26]))
+		contacts = append(contacts, c)
+	}
+	return contacts
+}
+
+// packAddr encodes an ipv4 address as 4 bytes of ip and the big endian port
+func packAddr(addr *net.UDPAddr) []byte {
+	packed := make([]byte, 6)
+	copy(packed, addr.IP.To4())
+	packed[4] = byte(addr.Port >> 8)
+	packed[5] = byte(addr.Port)
+	return packed
+}
+
+func unpackAddr(packed []byte) *net.UDPAddr {
+	ip := make(net.IP, 4)
+	copy(ip, packed[0:4])
+	return &net.UDPAddr{IP: ip, Port: int(packed[4])<<8 | int(packed[5])}
+}
@@ -1,14 +1,19 @@
 package downloader
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path"
 	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/G1itchZero/ZeroGo/content_manager"
 	"github.com/G1itchZero/ZeroGo/events"
 	"github.com/G1itchZero/ZeroGo/interfaces"
 	"github.com/G1itchZero/ZeroGo/peer_manager"
@@ -28,31 +33,58 @@ type Downloader struct {
 	Peers            *peer_manager.PeerManager
 	Tasks            tasks.Tasks
 	Files            map[string]*tasks.FileTask
+	Optional         map[string]*tasks.FileTask
 	Includes         []string
+	ContentManager   *content_manager.ContentManager
 	ContentRequested bool
 	Content          *gabs.Container
 	TotalFiles       int
-	StartedTasks     int
+	startedTasks     int64
 	OnChanges        chan events.SiteEvent
 	ProgressBar      *pb.ProgressBar
+	scheduled        map[*tasks.FileTask]bool
+	listed           bool
+	ctx              context.Context
+	cancel           context.CancelFunc
 	sync.Mutex
 }
 
+// peers to try before ScheduleFile gives up on a file
+const SCHEDULE_ATTEMPTS = 5
+
+// how often Download checks for pending tasks when no peer shows up
+const PENDING_CHECK_INTERVAL = time.Second
+
+// content.json files wait there, out of the site directory, until their signs are verified
+const STAGING_DIR = tasks.STAGING_DIR
+
+// peers asked for the user content.json files of a site
+const LIST_MODIFIED_PEERS = 3
+
+// user content.json files fetched at once
+const USER_CONTENT_WORKERS = 10
+
 func NewDownloader(address string) *Downloader {
 	green := color.New(color.FgGreen).SprintFunc()
+	ctx, cancel := context.WithCancel(context.Background())
 	d := Downloader{
-		Peers:        peer_manager.NewPeerManager(address),
-		Address:      address,
-		OnChanges:    make(chan events.SiteEvent, 400),
-		Files:        map[string]*tasks.FileTask{},
-		StartedTasks: 0,
-		Includes:     []string{},
+		Peers:     peer_manager.NewPeerManager(address),
+		scheduled: map[*tasks.FileTask]bool{},
+		ctx:       ctx,
+		cancel:    cancel,
+		Address:   address,
+		OnChanges: make(chan events.SiteEvent, 400),
+		Files:     map[string]*tasks.FileTask{},
+		Optional:  map[string]*tasks.FileTask{},
+		Includes:  []string{},
 	}
+	d.ContentManager = content_manager.NewContentManager(address)
 	if !utils.GetDebug() {
 		d.ProgressBar = pb.New(1).Prefix(green(address))
 		d.ProgressBar.SetRefreshRate(time.Millisecond * 50)
 		d.ProgressBar.ShowTimeLeft = false
 	}
+	d.Peers.Progress = d.progress
 	return &d
 }
 
@@ -64,47 +96,61 @@ func (d *Downloader) Download(done chan int, filter FilterFunc, modified float64
 	os.MkdirAll(dir, 0777)
 
 	d.ContentRequested = false
-	d.Tasks = tasks.Tasks{tasks.NewTask("content.json", "", 0, d.Address, d.OnChanges)}
+	d.Lock()
+	d.Tasks = tasks.Tasks{d.newContentTask("content.json")}
+	d.Unlock()
 
+	// the peers of the last run and the static ones don't have to wait for the trackers
+	d.Peers.ConnectStatic()
+	go d.Peers.LoadCachedPeers()
 	go d.Peers.Announce()
-	d.processContent(filter)
+	go d.Peers.StartPex()
+	if d.processContent(filter) == nil {
+		done <- 0
+		return false
+	}
 	d.ContentRequested = true
 	if d.Content.S("modified").Data().(float64) == modified {
 		log.Println(fmt.Sprintf("Not modified: %v", modified))
-		for _, task := range d.Tasks {
+		for _, task := range d.AllTasks() {
 			task.Done = true
 		}
 		done <- 0
 		return true
 	}
-	log.Println(fmt.Sprintf("Files in queue: %s", green(len(d.Tasks)-1)))
-	sort.Sort(d.Tasks)
-	for _, task := range d.Tasks {
+	queue := d.AllTasks()
+	log.Println(fmt.Sprintf("Files in queue: %s", green(len(queue)-1)))
+	sort.Sort(queue)
+	for _, task := range queue {
 		go d.ScheduleFile(task)
 	}
+	// tasks may also be finished or given up without a peer getting free
+	check := time.NewTicker(PENDING_CHECK_INTERVAL)
+	defer check.Stop()
 	for d.PendingTasksCount() > 0 {
 		select {
+		case <-d.ctx.Done():
+			done <- 0
+			return false
+		case <-check.C:
 		case p := <-d.Peers.OnPeers:
-			sort.Sort(d.Tasks)
-			n := 0
-			t := d.Tasks[n]
-			for t.Done {
-				n++
-				if n >= len(d.Tasks) {
-					n = -1
-					break
+			// a peer joined or got free: pick up a task that gave up on its peers
+			queue := d.AllTasks()
+			sort.Sort(queue)
+			for _, t := range queue {
+				if t.Done || d.isScheduled(t) {
+					continue
 				}
-				t = d.Tasks[n]
-			}
-			if n >= 0 {
 				log.WithFields(log.Fields{
 					"task": t,
 					"peer": p,
 				}).Debug("New new peer ->")
-				go d.ScheduleFileForPeer(t, p)
+				go d.ScheduleFile(t)
+				break
 			}
 		}
 	}
+	d.Peers.Completed()
 	done <- 0
 	return true
 }
@@ -120,66 +166,284 @@ func (d *Downloader) GetContent() (*gabs.Container, error) {
 
 func (d *Downloader) processContent(filter FilterFunc) *tasks.FileTask {
 	d.ContentRequested = true
-	task := d.ScheduleFile(d.Tasks[0])
+	task := d.AllTasks()[0]
+	for !task.Done {
+		d.ScheduleFile(task)
+		if d.ctx.Err() != nil {
+			return nil
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	if !d.acceptContent(task) {
+		return nil
+	}
 	content, _ := gabs.ParseJSON(task.GetContent())
 	d.Content = content
-	files, _ := content.S("files").ChildrenMap()
-	includes, _ := content.S("includes").ChildrenMap()
-	if includes != nil {
-		for name := range includes {
-			info, _ := gabs.Consume(map[string]interface{}{
-				"sha512": "", "size": 2048000.0,
-			})
-			files[name] = info
-			d.Includes = append(d.Includes, name)
-			// func(name string) {
-			t := tasks.NewTask(name, "", 2048000.0, d.Address, d.OnChanges)
-			d.Tasks = append(d.Tasks, t)
-			t = d.ScheduleFile(t)
-			// log.Fatal(t)
-			content, err := gabs.ParseJSON(t.GetContent())
-			if err != nil {
-				log.Fatalf("Include content error: %s", err)
+	d.TotalFiles = 1 // content.json
+	if !d.addFiles("content.json", filter) {
+		return nil
+	}
+	d.Lock()
+	d.listed = true
+	d.Unlock()
+	if d.ProgressBar != nil {
+		d.ProgressBar.Total = int64(d.TotalFiles)
+	}
+	return task
+
+}
+
+// addFiles queues the files of a verified content.json and notes its optional ones, then fetches the content.json files it includes
+// and the ones of its users, returns false when the download was stopped
+func (d *Downloader) addFiles(innerPath string, filter FilterFunc) bool {
+	content := d.ContentManager.Get(innerPath)
+	dir := path.Dir(innerPath)
+	for name, file := range content.Files() {
+		filename := path.Join(dir, name)
+		if !d.inSite(filename) || (filter != nil && !filter(filename)) {
+			continue
+		}
+		t := tasks.NewTask(filename, file.Sha512, float64(file.Size), d.Address, d.OnChanges)
+		d.addTask(t, true)
+		log.WithFields(log.Fields{
+			"task": t,
+		}).Debug("New task")
+	}
+	for name, file := range content.OptionalFiles() {
+		filename := path.Join(dir, name)
+		if !d.inSite(filename) || (filter != nil && !filter(filename)) {
+			continue
+		}
+		d.addOptional(tasks.NewTask(filename, file.Sha512, float64(file.Size), d.Address, d.OnChanges))
+	}
+	for _, include := range content.Includes() {
+		includePath := path.Join(dir, include)
+		if !d.inSite(includePath) || (filter != nil && !filter(includePath)) {
+			continue
+		}
+		d.Includes = append(d.Includes, includePath)
+		if !d.fetchContent(includePath, filter) {
+			return false
+		}
+	}
+	if content.HasUserContents() {
+		d.removeArchived(dir)
+		var wg sync.WaitGroup
+		slots := make(chan struct{}, USER_CONTENT_WORKERS)
+		for _, userPath := range d.listUserContents(dir) {
+			if !d.inSite(userPath) || (filter != nil && !filter(userPath)) {
+				continue
 			}
-			users, err := content.S("user_contents").S("archived").ChildrenMap()
-			if err != nil {
-				// log.Fatalf("Include users list error: %s", err)
+			wg.Add(1)
+			slots <- struct{}{}
+			go func(userPath string) {
+				defer wg.Done()
+				d.fetchContent(userPath, filter)
+				<-slots
+			}(userPath)
+		}
+		wg.Wait()
+	}
+	return d.ctx.Err() == nil
+}
+
+// inSite tells if the file stays in the site directory, names failing that are logged and skipped
+func (d *Downloader) inSite(filename string) bool {
+	root := path.Join(utils.GetDataPath(), d.Address)
+	if strings.HasPrefix(path.Join(root, filename), root+"/") {
+		return true
+	}
+	log.WithFields(log.Fields{
+		"site": d.Address,
+		"file": filename,
+	}).Warn("File out of the site directory skipped")
+	return false
+}
+
+// addTask queues a task, with files among the site's Files
+func (d *Downloader) addTask(task *tasks.FileTask, file bool) {
+	d.Lock()
+	defer d.Unlock()
+	d.queue(task, file)
+}
+
+// queue must be called with d locked
+func (d *Downloader) queue(task *tasks.FileTask, file bool) {
+	d.Tasks = append(d.Tasks, task)
+	d.TotalFiles++
+	if file {
+		d.Files[task.Filename] = task
+	}
+}
+
+// Listed tells if every content.json was processed, so files not queued or optional by now aren't part of the site
+func (d *Downloader) Listed() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.listed
+}
+
+// File returns the task of a queued site file
+func (d *Downloader) File(filename string) (*tasks.FileTask, bool) {
+	d.Lock()
+	defer d.Unlock()
+	task, ok := d.Files[filename]
+	return task, ok
+}
+
+// FileTasks returns the tasks of the queued site files
+func (d *Downloader) FileTasks() tasks.Tasks {
+	d.Lock()
+	defer d.Unlock()
+	res := tasks.Tasks{}
+	for _, task := range d.Files {
+		res = append(res, task)
+	}
+	return res
+}
+
+// fetchContent downloads and verifies a nested content.json and adds its files,
+// giving up on it after SCHEDULE_ATTEMPTS peers. Returns false when the download was stopped.
+func (d *Downloader) fetchContent(innerPath string, filter FilterFunc) bool {
+	t := d.newContentTask(innerPath)
+	d.addTask(t, false)
+	d.ScheduleFile(t)
+	if d.ctx.Err() != nil {
+		return false
+	}
+	if !t.Done {
+		log.WithFields(log.Fields{
+			"site":  d.Address,
+			"inner": innerPath,
+		}).Warn("No valid content.json found")
+		t.Finish()
+		t.Success = false
+		return true
+	}
+	if !d.acceptContent(t) {
+		return true
+	}
+	return d.addFiles(innerPath, filter)
+}
+
+// listUserContents asks a few peers which user content.json files exist in the directory
+func (d *Downloader) listUserContents(dir string) []string {
+	prefix := strings.TrimPrefix(dir+"/", "./")
+	found := map[string]float64{}
+	for i := 0; i < LIST_MODIFIED_PEERS && d.ctx.Err() == nil; i++ {
+		p := d.Peers.Get(d.ctx)
+		if p == nil {
+			break
+		}
+		modified, err := p.ListModified(d.ctx, d.Address, 0)
+		d.Peers.Release(p)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"peer": p,
+				"err":  err,
+			}).Debug("listModified error")
+			continue
+		}
+		for innerPath, m := range modified {
+			rest := strings.TrimPrefix(innerPath, prefix)
+			if rest == innerPath || strings.Count(rest, "/") != 1 || path.Base(rest) != "content.json" || !content_manager.IsValidRelativePath(rest) {
 				continue
 			}
-			for u := range users {
-				u = path.Join("data/users", u)
-				info, _ := gabs.Consume(map[string]interface{}{
-					"sha512": "", "size": 2048000.0,
-				})
-				files[path.Join(u, "content.json")] = info
-				files[path.Join(u, "data.json")] = info
+			if m > found[innerPath] {
+				found[innerPath] = m
 			}
-			// }(k)
 		}
 	}
-	d.TotalFiles = len(files) + 1 //content.json
-	for filename, child := range files {
-		if filter != nil && !filter(filename) {
-			d.TotalFiles--
+	res := []string{}
+	for innerPath, m := range found {
+		if d.ContentManager.IsArchived(innerPath, m) {
+			continue
+		}
+		res = append(res, innerPath)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// removeArchived deletes the user directories the site archived since we got them
+func (d *Downloader) removeArchived(dir string) {
+	root := path.Join(utils.GetDataPath(), d.Address, dir)
+	users, _ := ioutil.ReadDir(root)
+	for _, user := range users {
+		if !user.IsDir() {
+			continue
+		}
+		innerPath := strings.TrimPrefix(path.Join(dir, user.Name(), "content.json"), "./")
+		data, err := ioutil.ReadFile(path.Join(root, user.Name(), "content.json"))
+		if err != nil {
+			continue
+		}
+		content, err := content_manager.Decode(data)
+		if err != nil || !d.ContentManager.IsArchived(innerPath, content.Modified()) {
 			continue
 		}
-		file := child.Data().(map[string]interface{})
-		t := tasks.NewTask(filename, file["sha512"].(string), file["size"].(float64), d.Address, d.OnChanges)
-		log.Println(filename)
-		d.Tasks = append(d.Tasks, t)
-		d.Files[t.Filename] = t
 		log.WithFields(log.Fields{
-			"task": task,
-		}).Debug("New task")
+			"site":  d.Address,
+			"inner": innerPath,
+		}).Info("Removing archived user content")
+		os.RemoveAll(path.Join(root, user.Name()))
 	}
-	if d.ProgressBar != nil {
-		d.ProgressBar.Total = int64(d.TotalFiles)
+}
+
+// newContentTask downloads a content.json to the staging dir, a forged one fails the task like a bad hash
+func (d *Downloader) newContentTask(innerPath string) *tasks.FileTask {
+	task := tasks.NewTask(innerPath, "", 0, d.Address, d.OnChanges)
+	task.FullPath = path.Join(utils.GetDataPath(), STAGING_DIR, d.Address, innerPath)
+	os.MkdirAll(path.Dir(task.FullPath), 0777)
+	os.Remove(task.FullPath)
+	task.Verify = func(data []byte) error {
+		_, err := d.ContentManager.Verify(innerPath, data)
+		return err
 	}
 	return task
+}
 
+// acceptContent moves the verified content.json into the site, unless it's older than ours
+// or archived, and keeps it for the rules of the nested ones. Returns false if it was rejected.
+func (d *Downloader) acceptContent(task *tasks.FileTask) bool {
+	filename := path.Join(utils.GetDataPath(), d.Address, task.Filename)
+	staged := task.FullPath
+	task.FullPath = filename
+	data, _ := ioutil.ReadFile(staged)
+	newContent, err := content_manager.Decode(data)
+	if err != nil {
+		os.Remove(staged)
+		return false
+	}
+	if d.ContentManager.IsArchived(task.Filename, newContent.Modified()) {
+		os.Remove(staged)
+		return false
+	}
+	if data, err := ioutil.ReadFile(filename); err == nil {
+		if old, err := content_manager.Decode(data); err == nil && newContent.Modified() < old.Modified() {
+			log.WithFields(log.Fields{
+				"site":     d.Address,
+				"inner":    task.Filename,
+				"modified": newContent.Modified(),
+				"ours":     old.Modified(),
+			}).Warn("Older content.json rejected")
+			os.Remove(staged)
+			d.ContentManager.Add(task.Filename, old)
+			return true
+		}
+	}
+	os.MkdirAll(path.Dir(filename), 0777)
+	if err := os.Rename(staged, filename); err != nil {
+		log.WithFields(log.Fields{
+			"site": d.Address,
+			"err":  err,
+		}).Error("Can't save content.json")
+	}
+	d.ContentManager.Add(task.Filename, newContent)
+	return true
 }
 
-func (d *Downloader) ScheduleFileForPeer(task *tasks.FileTask, peer interfaces.IPeer) *tasks.FileTask {
+func (d *Downloader) requestFile(task *tasks.FileTask, peer interfaces.IPeer) error {
 	// filename := path.Join(utils.GetDataPath(), d.Address, task.Filename)
 	// if _, err := os.Stat(filename); err == nil && task.Filename != "content.json" {
 	// 	log.WithFields(log.Fields{
@@ -193,31 +457,101 @@ func (d *Downloader) ScheduleFileForPeer(task *tasks.FileTask, peer interfaces.I
 		"task": task.Filename,
 		"peer": peer.GetAddress(),
 	}).Info("Requesting file")
-	res := task.AddPeer(peer)
+	res := task.AddPeer(d.ctx, peer)
 	if d.ProgressBar != nil && res == nil {
 		d.ProgressBar.Increment()
 		d.ProgressBar.Update()
 	}
-	return task
+	return res
 }
 
+// ScheduleFile requests the file from the best peers, moving on to the next one
+// when a peer fails or times out. Does nothing if the task is already queued.
 func (d *Downloader) ScheduleFile(task *tasks.FileTask) *tasks.FileTask {
-	d.StartedTasks++
+	atomic.AddInt64(&d.startedTasks, 1)
 	if d.PendingTasksCount() == 0 {
 		return nil
 	}
-	peer := d.Peers.Get()
+	if !d.setScheduled(task, true) {
+		return task
+	}
+	defer d.setScheduled(task, false)
+	for attempt := 0; attempt < SCHEDULE_ATTEMPTS && !task.Done && d.ctx.Err() == nil; attempt++ {
+		peer := d.Peers.Get(d.ctx)
+		if peer == nil {
+			break
+		}
+		err := d.requestFile(task, peer)
+		d.Peers.Release(peer)
+		if err == nil || task.Done {
+			break
+		}
+		log.WithFields(log.Fields{
+			"task":    task.Filename,
+			"peer":    peer.GetAddress(),
+			"attempt": attempt,
+			"err":     err,
+		}).Warn("File request failed")
+	}
+	return task
+}
+
+// setScheduled marks the task as queued or running, returns false if it already was
+func (d *Downloader) setScheduled(task *tasks.FileTask, scheduled bool) bool {
+	d.Lock()
+	defer d.Unlock()
+	if scheduled && d.scheduled[task] {
+		return false
+	}
+	if scheduled {
+		d.scheduled[task] = true
+	} else {
+		delete(d.scheduled, task)
+	}
+	return true
+}
+
+func (d *Downloader) isScheduled(task *tasks.FileTask) bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.scheduled[task]
+}
+
+// Stop cancels every running request of the site
+func (d *Downloader) Stop() {
+	d.cancel()
+	d.Peers.Wake()
+	d.Peers.StopAnnounce()
+}
 
-	for peer == nil {
-		peer = d.Peers.Get()
-		time.Sleep(100)
+// progress returns the bytes of the site downloaded and still left
+func (d *Downloader) progress() (int64, int64) {
+	var downloaded, left int64
+	for _, task := range d.AllTasks() {
+		if task.Done {
+			downloaded += task.GetSize()
+		} else {
+			left += task.GetSize()
+		}
 	}
-	return d.ScheduleFileForPeer(task, peer)
+	return downloaded, left
+}
+
+// AllTasks returns a copy of the queued tasks, the user content workers add to them at any time
+func (d *Downloader) AllTasks() tasks.Tasks {
+	d.Lock()
+	defer d.Unlock()
+	return append(tasks.Tasks{}, d.Tasks...)
+}
+
+// StartedTasks counts the times a task was scheduled
+func (d *Downloader) StartedTasks() int {
+	return int(atomic.LoadInt64(&d.startedTasks))
 }
 
 func (d *Downloader) PendingTasksCount() int {
 	n := 0
-	for _, task := range d.Tasks {
+	for _, task := range d.AllTasks() {
 		if !task.Done {
 			n++
 		}
@@ -227,7 +561,7 @@ func (d *Downloader) PendingTasksCount() int {
 
 func (d *Downloader) PendingTasks() tasks.Tasks {
 	res := tasks.Tasks{}
-	for _, task := range d.Tasks {
+	for _, task := range d.AllTasks() {
 		if !task.Done {
 			res = append(res, task)
 		}
@@ -237,7 +571,7 @@ func (d *Downloader) PendingTasks() tasks.Tasks {
 
 func (d *Downloader) FinishedTasks() int {
 	n := 0
-	for _, task := range d.Tasks {
+	for _, task := range d.AllTasks() {
 		if task.Done {
 			n++
 		}
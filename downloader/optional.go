@@ -0,0 +1,202 @@
+package downloader
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+
+	"github.com/G1itchZero/ZeroGo/tasks"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// pinned optional files of every site, by site address
+const PINNED_FILENAME = "pinned.json"
+
+var pinned map[string][]string
+var pinnedLock sync.Mutex
+
+type OptionalFile struct {
+	InnerPath  string `json:"inner_path"`
+	Size       int64  `json:"size"`
+	Downloaded bool   `json:"is_downloaded"`
+	Pinned     bool   `json:"is_pinned"`
+}
+
+// loadPinned reads the pins on first use, must be called with pinnedLock held
+func loadPinned() {
+	if pinned != nil {
+		return
+	}
+	pinned = map[string][]string{}
+	filename := path.Join(utils.GetDataPath(), PINNED_FILENAME)
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &pinned)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't load pinned files")
+	}
+}
+
+func savePinned() {
+	filename := path.Join(utils.GetDataPath(), PINNED_FILENAME)
+	content, err := json.MarshalIndent(pinned, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filename, content, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't save pinned files")
+	}
+}
+
+func (d *Downloader) IsPinned(filename string) bool {
+	pinnedLock.Lock()
+	defer pinnedLock.Unlock()
+	return d.isPinned(filename)
+}
+
+// isPinned must be called with pinnedLock held
+func (d *Downloader) isPinned(filename string) bool {
+	loadPinned()
+	for _, f := range pinned[d.Address] {
+		if f == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// Pin keeps an optional file downloaded with the site from now on, fetching it right away
+func (d *Downloader) Pin(filename string) bool {
+	if _, ok := d.RequestOptional(filename); !ok {
+		return false
+	}
+	pinnedLock.Lock()
+	defer pinnedLock.Unlock()
+	if d.isPinned(filename) {
+		return true
+	}
+	pinned[d.Address] = append(pinned[d.Address], filename)
+	sort.Strings(pinned[d.Address])
+	savePinned()
+	return true
+}
+
+// Unpin stops downloading the optional file with the site, the copy we hold stays
+func (d *Downloader) Unpin(filename string) {
+	pinnedLock.Lock()
+	defer pinnedLock.Unlock()
+	loadPinned()
+	files := []string{}
+	for _, f := range pinned[d.Address] {
+		if f != filename {
+			files = append(files, f)
+		}
+	}
+	if len(files) == len(pinned[d.Address]) {
+		return
+	}
+	if len(files) == 0 {
+		delete(pinned, d.Address)
+	} else {
+		pinned[d.Address] = files
+	}
+	savePinned()
+}
+
+// addOptional keeps track of an optional file, only pinned ones are queued
+func (d *Downloader) addOptional(task *tasks.FileTask) {
+	pin := d.IsPinned(task.Filename)
+	d.Lock()
+	defer d.Unlock()
+	d.Optional[task.Filename] = task
+	if _, queued := d.Files[task.Filename]; pin && !queued {
+		d.queue(task, true)
+	}
+}
+
+// RequestOptional queues an optional file on demand, a valid copy on disk finishes it right away.
+// Returns false if the site has no such optional file.
+func (d *Downloader) RequestOptional(filename string) (*tasks.FileTask, bool) {
+	d.Lock()
+	task, ok := d.Optional[filename]
+	_, queued := d.Files[filename]
+	if ok && !queued {
+		d.queue(task, true)
+	}
+	d.Unlock()
+	if !ok {
+		return nil, false
+	}
+	if queued {
+		return task, true
+	}
+	if task.Check() {
+		task.Finish()
+	}
+	if !task.Done {
+		log.WithFields(log.Fields{
+			"site": d.Address,
+			"task": task,
+		}).Info("Requesting optional file")
+		go d.ScheduleFile(task)
+	}
+	return task, true
+}
+
+// hasFile tells if we hold the file: downloaded in this run or left on disk by a previous one
+func (d *Downloader) hasFile(task *tasks.FileTask) bool {
+	if task.Done {
+		return task.Success
+	}
+	info, err := os.Stat(task.FullPath)
+	return err == nil && !task.Started && info.Size() == task.GetSize()
+}
+
+// OptionalFiles lists the optional files of the site by inner path
+func (d *Downloader) OptionalFiles() []OptionalFile {
+	d.Lock()
+	optional := []*tasks.FileTask{}
+	for _, task := range d.Optional {
+		optional = append(optional, task)
+	}
+	d.Unlock()
+	res := []OptionalFile{}
+	for _, task := range optional {
+		res = append(res, OptionalFile{
+			InnerPath:  task.Filename,
+			Size:       task.GetSize(),
+			Downloaded: d.hasFile(task),
+			Pinned:     d.IsPinned(task.Filename),
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].InnerPath < res[j].InnerPath
+	})
+	return res
+}
+
+// OptionalSize returns the bytes of the optional files, all of them and the ones we hold
+func (d *Downloader) OptionalSize() (int64, int64) {
+	var size, downloaded int64
+	for _, file := range d.OptionalFiles() {
+		size += file.Size
+		if file.Downloaded {
+			downloaded += file.Size
+		}
+	}
+	return size, downloaded
+}
@@ -0,0 +1,427 @@
+package file_server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/peer_manager"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// FILE_BUFF is the max chunk size we send for a single getFile/streamFile request
+const FILE_BUFF = 512 * 1024
+
+// first byte of a TLS ClientHello record
+const tlsRecordHandshake = 0x16
+
+type FileServer struct {
+	Port        int
+	Listener    net.Listener
+	Connections map[string]*Connection
+	Sites       PeerExchanger
+	config      *tls.Config
+	sync.Mutex
+}
+
+// PeerExchanger gives access to the peers of the sites we serve
+type PeerExchanger interface {
+	Pex(site string, peers peer.PexPeers, need int) (peer.PexPeers, bool)
+}
+
+// UploadCounter is told how many bytes of each site we served
+type UploadCounter interface {
+	AddUploaded(site string, bytes int)
+}
+
+type Connection struct {
+	Address string
+	Conn    net.Conn
+	Crypt   string
+	reader  *bufio.Reader
+	wlock   *sync.Mutex
+}
+
+type request struct {
+	Cmd    string                 `msgpack:"cmd"`
+	ReqID  int                    `msgpack:"req_id"`
+	Params map[string]interface{} `msgpack:"params"`
+}
+
+// peekedConn lets us sniff the first byte of a connection without losing it
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func NewFileServer(port int) *FileServer {
+	fs := FileServer{
+		Port:        port,
+		Connections: map[string]*Connection{},
+	}
+	return &fs
+}
+
+func (fs *FileServer) Listen() error {
+	certFilename := path.Join(utils.GetDataPath(), "cert-rsa.pem")
+	keyFilename := path.Join(utils.GetDataPath(), "key-rsa.pem")
+	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	if err != nil {
+		return fmt.Errorf("File server cert error: %v", err)
+	}
+	fs.config = &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", fs.Port))
+	if err != nil {
+		return fmt.Errorf("File server listen error: %v", err)
+	}
+	fs.Listener = listener
+	utils.SetFileserverPort(fs.Port)
+	log.WithFields(log.Fields{
+		"port": fs.Port,
+	}).Info("File server listening")
+	return nil
+}
+
+func (fs *FileServer) Serve() error {
+	if fs.Listener == nil {
+		if err := fs.Listen(); err != nil {
+			return err
+		}
+	}
+	for {
+		conn, err := fs.Listener.Accept()
+		if err != nil {
+			utils.SetFileserverPort(0)
+			return fmt.Errorf("File server accept error: %v", err)
+		}
+		if !peer_manager.GetBudget().ReserveInbound() {
+			log.WithFields(log.Fields{
+				"address": conn.RemoteAddr().String(),
+			}).Debug("Too many connections, refused")
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer peer_manager.GetBudget().ReleaseInbound()
+			fs.handleConnection(conn)
+		}()
+	}
+}
+
+func (fs *FileServer) Stop() {
+	if fs.Listener != nil {
+		fs.Listener.Close()
+	}
+	fs.Lock()
+	for _, c := range fs.Connections {
+		c.Conn.Close()
+	}
+	fs.Unlock()
+}
+
+func (fs *FileServer) handleConnection(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(20 * time.Second))
+	first, err := reader.Peek(1)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	c := &Connection{
+		Address: conn.RemoteAddr().String(),
+		Conn:    &peekedConn{conn, reader},
+		wlock:   &sync.Mutex{},
+	}
+	if first[0] == tlsRecordHandshake {
+		c.Conn = tls.Server(c.Conn, fs.config)
+		c.Crypt = "tls-rsa"
+	}
+	c.reader = bufio.NewReader(c.Conn)
+
+	fs.Lock()
+	fs.Connections[c.Address] = c
+	fs.Unlock()
+	defer func() {
+		fs.Lock()
+		delete(fs.Connections, c.Address)
+		fs.Unlock()
+		c.Conn.Close()
+	}()
+
+	log.WithFields(log.Fields{
+		"address": c.Address,
+		"crypt":   c.Crypt,
+	}).Debug("Incoming connection")
+
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(2 * time.Minute))
+		req := request{}
+		if err := msgpack.NewDecoder(c.reader).Decode(&req); err != nil {
+			if err != io.EOF {
+				log.WithFields(log.Fields{
+					"address": c.Address,
+					"err":     err,
+				}).Debug("Incoming connection closed")
+			}
+			return
+		}
+		if err := fs.handleRequest(c, &req); err != nil {
+			log.WithFields(log.Fields{
+				"address": c.Address,
+				"cmd":     req.Cmd,
+				"err":     err,
+			}).Warn("Request error")
+			return
+		}
+	}
+}
+
+func (fs *FileServer) handleRequest(c *Connection, req *request) error {
+	switch req.Cmd {
+	case "handshake":
+		return fs.actionHandshake(c, req)
+	case "ping":
+		return c.respond(req.ReqID, map[string]interface{}{"body": "Pong!"}, nil)
+	case "getFile":
+		return fs.actionGetFile(c, req, false)
+	case "streamFile":
+		return fs.actionGetFile(c, req, true)
+	case "pex":
+		return fs.actionPex(c, req)
+	}
+	return c.respond(req.ReqID, map[string]interface{}{
+		"error": fmt.Sprintf("Unknown cmd: %s", req.Cmd),
+	}, nil)
+}
+
+func (fs *FileServer) actionHandshake(c *Connection, req *request) error {
+	if paramString(req.Params, "protocol") != peer.PROTOCOL {
+		c.respond(req.ReqID, map[string]interface{}{"error": "Incompatible protocol"}, nil)
+		return peer.ErrIncompatible
+	}
+	if paramString(req.Params, "peer_id") == utils.GetPeerID() {
+		return peer.ErrSelf
+	}
+	host, _, _ := net.SplitHostPort(c.Address)
+	utils.SetExternalIP(paramString(req.Params, "target_ip"), host)
+	hs := peer.NewHandshake(host)
+	upgrade := false
+	if c.Crypt == "" && cryptSupported(req.Params["crypt_supported"], "tls-rsa") {
+		upgrade = true
+	} else {
+		hs.Crypt = c.Crypt
+	}
+	answer := map[string]interface{}{
+		"version":         hs.Version,
+		"rev":             hs.Rev,
+		"protocol":        hs.Protocol,
+		"peer_id":         hs.PeerID,
+		"fileserver_port": hs.FileserverPort,
+		"port_opened":     hs.PortOpened,
+		"target_ip":       hs.TargetIP,
+		"crypt_supported": []string{"tls-rsa"},
+		"crypt":           nil,
+	}
+	if upgrade || c.Crypt != "" {
+		answer["crypt"] = "tls-rsa"
+	}
+	if err := c.respond(req.ReqID, answer, nil); err != nil {
+		return err
+	}
+	if upgrade {
+		// plaintext peers switch to tls right after our handshake answer
+		conn := tls.Server(&peekedConn{c.Conn, c.reader}, fs.config)
+		c.Conn = conn
+		c.Crypt = "tls-rsa"
+		c.reader = bufio.NewReader(conn)
+	}
+	return nil
+}
+
+func (fs *FileServer) actionGetFile(c *Connection, req *request, stream bool) error {
+	site := paramString(req.Params, "site")
+	innerPath := paramString(req.Params, "inner_path")
+	location := paramInt(req.Params, "location")
+	filename, err := sitePath(site, innerPath)
+	if err != nil {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "File read error"}, nil)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "File read error"}, nil)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil || location < 0 || int64(location) > info.Size() {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "File read error"}, nil)
+	}
+	buf := make([]byte, FILE_BUFF)
+	n, err := file.ReadAt(buf, int64(location))
+	if err != nil && err != io.EOF {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "File read error"}, nil)
+	}
+	buf = buf[:n]
+	answer := map[string]interface{}{
+		"size":     info.Size(),
+		"location": location + n,
+	}
+	log.WithFields(log.Fields{
+		"address":  c.Address,
+		"site":     site,
+		"file":     innerPath,
+		"location": location,
+		"bytes":    n,
+	}).Debug("Serving file")
+	if counter, ok := fs.Sites.(UploadCounter); ok {
+		counter.AddUploaded(site, n)
+	}
+	if stream {
+		answer["stream_bytes"] = n
+		return c.respond(req.ReqID, answer, buf)
+	}
+	answer["body"] = buf
+	return c.respond(req.ReqID, answer, nil)
+}
+
+func (fs *FileServer) actionPex(c *Connection, req *request) error {
+	if fs.Sites == nil {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "Unknown site"}, nil)
+	}
+	need := paramInt(req.Params, "need")
+	if need <= 0 || need > 30 {
+		need = 30
+	}
+	received := peer.PexPeers{
+		IPv4:  paramBytesList(req.Params, "peers"),
+		IPv6:  paramBytesList(req.Params, "peers_ipv6"),
+		Onion: paramBytesList(req.Params, "peers_onion"),
+	}
+	peers, ok := fs.Sites.Pex(paramString(req.Params, "site"), received, need)
+	if !ok {
+		return c.respond(req.ReqID, map[string]interface{}{"error": "Unknown site"}, nil)
+	}
+	return c.respond(req.ReqID, map[string]interface{}{
+		"peers":       peers.IPv4,
+		"peers_ipv6":  peers.IPv6,
+		"peers_onion": peers.Onion,
+	}, nil)
+}
+
+func (c *Connection) respond(to int, answer map[string]interface{}, stream []byte) error {
+	answer["cmd"] = "response"
+	answer["to"] = to
+	data, err := msgpack.Marshal(answer)
+	if err != nil {
+		return err
+	}
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	c.Conn.SetWriteDeadline(time.Now().Add(time.Minute))
+	if _, err = c.Conn.Write(data); err != nil {
+		return err
+	}
+	if stream != nil {
+		_, err = c.Conn.Write(stream)
+	}
+	return err
+}
+
+// sitePath resolves a requested file inside a downloaded site, refusing anything outside of it
+func sitePath(site string, innerPath string) (string, error) {
+	if site == "" || strings.ContainsAny(site, "/\\") || strings.HasPrefix(site, ".") {
+		return "", errors.New("Bad site")
+	}
+	root := path.Join(utils.GetDataPath(), site)
+	if exists, _ := utils.Exists(path.Join(root, "content.json")); !exists {
+		return "", errors.New("Unknown site")
+	}
+	filename := path.Join(root, innerPath)
+	if !strings.HasPrefix(filename, root+"/") {
+		return "", errors.New("Bad inner path")
+	}
+	return filename, nil
+}
+
+func cryptSupported(supported interface{}, crypt string) bool {
+	switch s := supported.(type) {
+	case []interface{}:
+		for _, c := range s {
+			if c == crypt {
+				return true
+			}
+		}
+	case bool:
+		return s
+	}
+	return false
+}
+
+func paramString(params map[string]interface{}, key string) string {
+	switch v := params[key].(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+func paramBytesList(params map[string]interface{}, key string) [][]byte {
+	res := [][]byte{}
+	list, ok := params[key].([]interface{})
+	if !ok {
+		return res
+	}
+	for _, item := range list {
+		switch v := item.(type) {
+		case []byte:
+			res = append(res, v)
+		case string:
+			res = append(res, []byte(v))
+		}
+	}
+	return res
+}
+
+func paramInt(params map[string]interface{}, key string) int {
+	switch v := params[key].(type) {
+	case int:
+		return v
+	case int8:
+		return int(v)
+	case int16:
+		return int(v)
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case uint8:
+		return int(v)
+	case uint16:
+		return int(v)
+	case uint32:
+		return int(v)
+	case uint64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
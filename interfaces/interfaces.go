@@ -1,5 +1,7 @@
 package interfaces
 
+import "context"
+
 type ISite interface {
 }
 
@@ -12,10 +14,11 @@ type ITask interface {
 	AppendContent([]byte, int)
 	GetSize() int64
 	Start()
+	Reset()
 	Check() bool
 	Finish()
 }
 type IPeer interface {
-	AddTask(ITask) error
+	AddTask(context.Context, ITask) error
 	GetAddress() string
 }
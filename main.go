@@ -3,8 +3,11 @@ package main
 import (
 	"fmt"
 	"os"
+	"os/signal"
 	"path"
 	"strings"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"net/http"
@@ -12,6 +15,11 @@ import (
 
 	l "log"
 
+	"github.com/G1itchZero/ZeroGo/announce_local"
+	"github.com/G1itchZero/ZeroGo/dht"
+	"github.com/G1itchZero/ZeroGo/file_server"
+	"github.com/G1itchZero/ZeroGo/peer_manager"
+	"github.com/G1itchZero/ZeroGo/reputation"
 	"github.com/G1itchZero/ZeroGo/server"
 	"github.com/G1itchZero/ZeroGo/site_manager"
 	"github.com/G1itchZero/ZeroGo/utils"
@@ -31,6 +39,15 @@ func main() {
 		"id": utils.GetPeerID(),
 	}).Info("Your Peer ID")
 
+	// the reputation store writes with a delay, don't lose the last bans on exit
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupt
+		reputation.Flush()
+		os.Exit(1)
+	}()
+
 	app := cli.NewApp()
 	app.Name = "ZeroGo"
 	app.Usage = "ZeroNet gate"
@@ -50,6 +67,37 @@ func main() {
 			Value: 43210,
 			Usage: "serving port",
 		},
+		cli.IntFlag{
+			Name:  "fileserver-port",
+			Value: 15441,
+			Usage: "port for incoming peer connections, 0 to disable seeding",
+		},
+		cli.IntFlag{
+			Name:  "dht-port",
+			Value: 15441,
+			Usage: "udp port of the DHT node, 0 to disable the DHT",
+		},
+		cli.IntFlag{
+			Name:  "lan-port",
+			Value: announce_local.BROADCAST_PORT,
+			Usage: "udp port to find other clients on the LAN, 0 to disable",
+		},
+		cli.StringFlag{
+			Name:  "proxy",
+			Usage: "socks5://host:port proxy for all peer and tracker connections",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Usage: "json config file, data/config.json by default",
+		},
+		cli.StringSliceFlag{
+			Name:  "tracker",
+			Usage: "tracker to announce to, can be repeated, replaces the configured ones",
+		},
+		cli.StringSliceFlag{
+			Name:  "peer",
+			Usage: "host:port of a peer to always connect to, site=host:port for a single site, can be repeated",
+		},
 		cli.StringFlag{
 			Name:  "homepage",
 			Value: utils.ZN_HOMEPAGE,
@@ -57,6 +105,28 @@ func main() {
 		},
 	}
 
+	app.Before = func(c *cli.Context) error {
+		configPath := c.String("config")
+		if configPath == "" {
+			configPath = utils.GetConfigPath()
+		}
+		if err := utils.LoadConfig(configPath); err != nil {
+			return err
+		}
+		if len(c.StringSlice("tracker")) > 0 {
+			utils.SetTrackers(c.StringSlice("tracker"))
+		}
+		for _, p := range c.StringSlice("peer") {
+			if err := utils.AddStaticPeer(p); err != nil {
+				return err
+			}
+		}
+		if c.String("proxy") != "" {
+			return utils.SetProxy(c.String("proxy"))
+		}
+		return nil
+	}
+
 	sm := site_manager.NewSiteManager()
 
 	app.Commands = []cli.Command{
@@ -75,12 +145,96 @@ func main() {
 				return nil
 			},
 		},
+		{
+			Name:  "trackers",
+			Usage: "show tracker stats",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "announce",
+					Usage: "announce the homepage to every tracker first",
+				},
+				cli.BoolFlag{
+					Name:  "scrape",
+					Usage: "show the peer counts of the site (the homepage by default) known by udp trackers",
+				},
+			},
+			Action: func(c *cli.Context) error {
+				if c.Bool("announce") {
+					pm := peer_manager.NewPeerManager(utils.ZN_HOMEPAGE)
+					pm.Announce()
+					for range utils.GetTrackers() {
+						<-pm.OnAnnounce
+					}
+				}
+				w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+				fmt.Fprintln(w, "TRACKER\tOK\tFAILED\tPEERS\tLATENCY\tLAST ANNOUNCE\tLAST ERROR")
+				for _, stats := range peer_manager.GetTrackerStats() {
+					last := "never"
+					if !stats.LastAnnounce.IsZero() {
+						last = stats.LastAnnounce.Format(time.RFC3339)
+					}
+					if time.Now().Before(stats.BackoffUntil) {
+						last += " (backing off)"
+					}
+					fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%.2fs\t%s\t%s\n", stats.Tracker, stats.Successes,
+						stats.Failures, stats.LastPeers, stats.Latency, last, stats.LastError)
+				}
+				if c.Bool("scrape") {
+					address := utils.ZN_HOMEPAGE
+					if c.Args().First() != "" {
+						address = c.Args().First()
+					}
+					pm := peer_manager.NewPeerManager(address)
+					fmt.Fprintln(w, "\nTRACKER\tSEEDERS\tLEECHERS\tCOMPLETED")
+					for _, tracker := range utils.GetTrackers() {
+						if !strings.HasPrefix(tracker, "udp://") {
+							continue
+						}
+						res, err := pm.Scrape(tracker)
+						if err != nil {
+							fmt.Fprintf(w, "%s\t%s\n", tracker, err)
+							continue
+						}
+						fmt.Fprintf(w, "%s\t%d\t%d\t%d\n", tracker, res.Seeders, res.Leechers, res.Completed)
+					}
+				}
+				return w.Flush()
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) error {
 		utils.SetDebug(c.Bool("debug"))
 		utils.SetHomepage(c.String("homepage"))
 
+		if c.Int("fileserver-port") != 0 {
+			fs := file_server.NewFileServer(c.Int("fileserver-port"))
+			fs.Sites = sm
+			if err := fs.Listen(); err != nil {
+				log.Error(err)
+			} else {
+				go func() {
+					log.Error(fs.Serve())
+				}()
+			}
+		}
+
+		if c.Int("dht-port") != 0 && !utils.HasProxy() {
+			dhtFile := path.Join(utils.GetDataPath(), dht.FILENAME)
+			if _, err := dht.Start(c.Int("dht-port"), dhtFile, dht.BOOTSTRAP_NODES); err != nil {
+				log.Error(err)
+			}
+		}
+
+		if c.Int("lan-port") != 0 && !utils.HasProxy() {
+			lan := announce_local.NewAnnouncer(c.Int("lan-port"), sm)
+			if err := lan.Listen(); err != nil {
+				log.Error(err)
+			} else {
+				go lan.Serve()
+			}
+		}
+
 		hasMedia, _ := utils.Exists(path.Join(utils.GetDataPath(), utils.ZN_UPDATE))
 
 		sync := make(chan int)
@@ -128,4 +282,5 @@ func main() {
 	}
 
 	app.Run(os.Args)
+	reputation.Flush()
 }
@@ -0,0 +1,95 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// ResponsePeers holds the "peers" of an answer: packed addresses for pex,
+// one dict of packed addresses per announced hash for bootstrapper announces
+type ResponsePeers struct {
+	Packed [][]byte
+	Sites  []PexPeers
+}
+
+func (rp *ResponsePeers) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	list, _ := v.([]interface{})
+	for _, item := range list {
+		if packed, ok := toBytes(item); ok {
+			rp.Packed = append(rp.Packed, packed)
+			continue
+		}
+		if site, ok := item.(map[interface{}]interface{}); ok {
+			peers := NewPexPeers()
+			// ip4 is what old bootstrappers call ipv4
+			peers.IPv4 = append(bytesList(site["ipv4"]), bytesList(site["ip4"])...)
+			peers.IPv6 = bytesList(site["ipv6"])
+			peers.Onion = bytesList(site["onion"])
+			rp.Sites = append(rp.Sites, peers)
+		}
+	}
+	return nil
+}
+
+func toBytes(v interface{}) ([]byte, bool) {
+	switch v := v.(type) {
+	case []byte:
+		return v, true
+	case string:
+		return []byte(v), true
+	}
+	return nil, false
+}
+
+func bytesList(v interface{}) [][]byte {
+	list, _ := v.([]interface{})
+	res := [][]byte{}
+	for _, item := range list {
+		if b, ok := toBytes(item); ok {
+			res = append(res, b)
+		}
+	}
+	return res
+}
+
+type RequestAnnounce struct {
+	Hashes    [][]byte `msgpack:"hashes"`
+	Onions    []string `msgpack:"onions"`
+	Port      int      `msgpack:"port"`
+	NeedTypes []string `msgpack:"need_types"`
+	NeedNum   int      `msgpack:"need_num"`
+	Add       []string `msgpack:"add"`
+}
+
+// Announce tells a bootstrapper we serve the sites of the given sha256 hashes
+// and returns the peers it knows for each of them, in the same order
+func (peer *Peer) Announce(ctx context.Context, hashes [][]byte, port int, add []string, need int) ([]PexPeers, error) {
+	request := Request{
+		Cmd: "announce",
+		Params: RequestAnnounce{
+			Hashes:    hashes,
+			Onions:    []string{},
+			Port:      port,
+			NeedTypes: []string{"ip4", "ipv4", "ipv6", "onion"},
+			NeedNum:   need,
+			Add:       add,
+		},
+	}
+	message, err := peer.request(ctx, &request)
+	if err != nil {
+		return nil, err
+	}
+	if message.Error != "" {
+		return nil, fmt.Errorf("announce error: %s", message.Error)
+	}
+	if len(message.Peers.Sites) > len(hashes) {
+		return nil, fmt.Errorf("announce error: %d answers for %d hashes", len(message.Peers.Sites), len(hashes))
+	}
+	return message.Peers.Sites, nil
+}
@@ -0,0 +1,117 @@
+package peer
+
+import (
+	"context"
+	"math"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// how often idle connections are checked
+const KEEPALIVE_INTERVAL = 20 * time.Second
+
+// connections without any answer for that long get pinged
+const KEEPALIVE_IDLE = time.Minute
+
+// failed pings in a row before the connection is dropped
+const KEEPALIVE_FAILS = 2
+
+type Stats struct {
+	RTT           time.Duration
+	LastActivity  time.Time
+	BytesReceived int64
+	DownloadTime  time.Duration
+	Downloads     int
+	Errors        int
+}
+
+func (peer *Peer) keepalive(ticker *time.Ticker, done chan struct{}) {
+	failed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		peer.Lock()
+		idle := time.Since(peer.Stats.LastActivity)
+		peer.Unlock()
+		if idle < KEEPALIVE_IDLE {
+			continue
+		}
+		if err := peer.Ping(context.Background()); err != nil {
+			failed++
+			if failed >= KEEPALIVE_FAILS {
+				log.WithFields(log.Fields{
+					"peer": peer,
+					"err":  err,
+				}).Debug("Peer is dead, dropping")
+				peer.Stop()
+				return
+			}
+			continue
+		}
+		failed = 0
+	}
+}
+
+// Idle returns how long the peer hasn't sent anything
+func (peer *Peer) Idle() time.Duration {
+	peer.Lock()
+	defer peer.Unlock()
+	return time.Since(peer.Stats.LastActivity)
+}
+
+func (peer *Peer) recordRTT(rtt time.Duration) {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.Stats.RTT == 0 {
+		peer.Stats.RTT = rtt
+		return
+	}
+	// smooth it out, a single slow ping shouldn't ruin the peer
+	peer.Stats.RTT = (peer.Stats.RTT*7 + rtt*3) / 10
+}
+
+func (peer *Peer) recordDownload(bytes int, duration time.Duration) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.Stats.BytesReceived += int64(bytes)
+	peer.Stats.DownloadTime += duration
+	peer.Stats.Downloads++
+}
+
+func (peer *Peer) recordError() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.Stats.Errors++
+}
+
+// Speed returns the average download speed in bytes per second
+func (peer *Peer) Speed() float64 {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.Stats.DownloadTime <= 0 {
+		return 0
+	}
+	return float64(peer.Stats.BytesReceived) / peer.Stats.DownloadTime.Seconds()
+}
+
+// Score rates the peer by throughput, round-trip time and failed downloads, higher is better
+func (peer *Peer) Score() float64 {
+	speed := peer.Speed()
+	peer.Lock()
+	defer peer.Unlock()
+	score := 1.0
+	if speed > 0 {
+		// +1 per order of magnitude of KB/s
+		score += math.Log10(1 + speed/1024)
+	}
+	if peer.Stats.RTT > 0 {
+		score /= 1 + peer.Stats.RTT.Seconds()
+	}
+	downloads := float64(peer.Stats.Downloads)
+	score *= (downloads + 1) / (downloads + float64(peer.Stats.Errors) + 1)
+	return score
+}
@@ -0,0 +1,30 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+)
+
+type RequestListModified struct {
+	Site  string `msgpack:"site"`
+	Since int64  `msgpack:"since"`
+}
+
+// ListModified returns the content.json files of the site the peer has changed since the unix time, with their modified
+func (peer *Peer) ListModified(ctx context.Context, site string, since int64) (map[string]float64, error) {
+	request := Request{
+		Cmd: "listModified",
+		Params: RequestListModified{
+			Site:  site,
+			Since: since,
+		},
+	}
+	message, err := peer.request(ctx, &request)
+	if err != nil {
+		return nil, err
+	}
+	if message.Error != "" {
+		return nil, fmt.Errorf("listModified error: %s", message.Error)
+	}
+	return message.ModifiedFiles, nil
+}
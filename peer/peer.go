@@ -1,20 +1,24 @@
 package peer
 
 import (
+	"bufio"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"math"
 	r "math/rand"
 	"net"
-	"os"
 	"path"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/G1itchZero/ZeroGo/interfaces"
+	"github.com/G1itchZero/ZeroGo/reputation"
 	"github.com/G1itchZero/ZeroGo/utils"
 	_ "github.com/Sirupsen/logrus"
 	log "github.com/Sirupsen/logrus"
@@ -29,16 +33,70 @@ const (
 	Connected
 )
 
+// wait that long for a new message on an idle connection before checking it again
+const IDLE_TIMEOUT = 20 * time.Second
+
+// max time to receive a whole message once it started to arrive
+const READ_TIMEOUT = 60 * time.Second
+
+const READ_BUFF = 64 * 1024
+
+// max time to wait for the answer of a single request
+const REQUEST_TIMEOUT = 30 * time.Second
+
+var ErrNotConnected = errors.New("Peer is not connected")
+var ErrConnectionLost = errors.New("Connection lost")
+var ErrOnionNoProxy = errors.New("Onion peers are only reachable through a proxy")
+var ErrIncompatible = errors.New("Incompatible protocol")
+var ErrSelf = errors.New("Connected to ourselves")
+var ErrCertPin = errors.New("Certificate doesn't match the pinned key")
+
+// the only protocol we speak
+const PROTOCOL = "v2"
+
+// CryptList decodes crypt_supported sent either as a list or, by old clients, as a bool
+type CryptList []string
+
+func (cl *CryptList) DecodeMsgpack(dec *msgpack.Decoder) error {
+	v, err := dec.DecodeInterface()
+	if err != nil {
+		return err
+	}
+	*cl = CryptList{}
+	switch v := v.(type) {
+	case []interface{}:
+		for _, c := range v {
+			if s, ok := c.(string); ok {
+				*cl = append(*cl, s)
+			}
+		}
+	case bool:
+		if v {
+			*cl = CryptList{"tls-rsa"}
+		}
+	}
+	return nil
+}
+
+func (cl CryptList) Contains(crypt string) bool {
+	for _, c := range cl {
+		if c == crypt {
+			return true
+		}
+	}
+	return false
+}
+
 type Handshake struct {
-	Version        string `msgpack:"version"`
-	Rev            int    `msgpack:"rev"`
-	Protocol       string `msgpack:"protocol"`
-	PeerID         string `msgpack:"peer_id"`
-	FileserverPort int    `msgpack:"fileserver_port"`
-	PortOpened     bool   `msgpack:"port_opened"`
-	TargetIP       string `msgpack:"target_ip"`
-	CryptSupported bool   `msgpack:"crypt_supported"`
-	Crypt          string `msgpack:"crypt"`
+	Version        string    `msgpack:"version"`
+	Rev            int       `msgpack:"rev"`
+	Protocol       string    `msgpack:"protocol"`
+	PeerID         string    `msgpack:"peer_id"`
+	FileserverPort int       `msgpack:"fileserver_port"`
+	PortOpened     bool      `msgpack:"port_opened"`
+	TargetIP       string    `msgpack:"target_ip"`
+	CryptSupported CryptList `msgpack:"crypt_supported"`
+	Crypt          string    `msgpack:"crypt"`
 }
 
 type RequestFile struct {
@@ -51,228 +109,547 @@ type Request struct {
 	Cmd    string      `msgpack:"cmd"`
 	ReqID  int         `msgpack:"req_id"`
 	Params interface{} `msgpack:"params"`
-	Size   int64
 }
 
 type Response struct {
-	Cmd         string `msgpack:"cmd"`
-	ReqID       int    `msgpack:"req_id"`
-	Body        string `msgpack:"body"`
-	Size        int    `msgpack:"size"`
-	StreamBytes int    `msgpack:"stream_bytes"`
-	To          int    `msgpack:"to"`
-	Location    int    `msgpack:"location"`
-	Buffer      []byte
+	Cmd         string        `msgpack:"cmd"`
+	ReqID       int           `msgpack:"req_id"`
+	Body        string        `msgpack:"body"`
+	Size        int           `msgpack:"size"`
+	StreamBytes int           `msgpack:"stream_bytes"`
+	To          int           `msgpack:"to"`
+	Location    int           `msgpack:"location"`
+	Error       string        `msgpack:"error"`
+	Peers       ResponsePeers `msgpack:"peers"`
+	PeersIPv6   [][]byte      `msgpack:"peers_ipv6"`
+	PeersOnion  [][]byte      `msgpack:"peers_onion"`
+	// content.json inner paths and their modified, answering listModified
+	ModifiedFiles map[string]float64 `msgpack:"modified_files"`
+	Buffer        []byte
+	// handshake answers carry the remote handshake inline
+	Handshake `msgpack:",inline"`
 }
 
 type Peer struct {
-	State       State
-	Address     string
-	Port        uint64
-	Connection  *tls.Conn
-	ReqID       int
-	Tasks       []interfaces.ITask
-	ActiveTasks int
-	Cancel      chan struct{}
-	buffers     map[int][]byte
-	chans       map[int]chan Response
-	Ticker      *time.Ticker
-	Listening   bool
-	Free        chan *Peer
-	wlock       *sync.Mutex
-	sizes       map[int]int64
+	State        State
+	Address      string
+	Port         uint64
+	Connection   *tls.Conn
+	ReqID        int
+	Tasks        []interfaces.ITask
+	ActiveTasks  int
+	chans        map[int]chan Response
+	Ticker       *time.Ticker
+	Listening    bool
+	NoStreamFile bool
+	Local        bool // found on our LAN, preferred over every other peer
+	Static       bool // configured by the user, never dropped for another one
+	Stats        Stats
+	Remote       Handshake // what the peer told about itself in its handshake
+	CertHash     string    // hex sha256 of the tls certificate the peer showed
+	done         chan struct{}
+	wlock        *sync.Mutex
+	connectLock  sync.Mutex
 	sync.Mutex
 }
 
-func (peer *Peer) AddTask(task interfaces.ITask) error {
-	peer.Tasks = append(peer.Tasks, task)
-	_, res := peer.Download(task)
-	peer.Free <- peer
+func (peer *Peer) AddTask(ctx context.Context, task interfaces.ITask) error {
+	_, res := peer.Download(ctx, task)
 	return res
 }
 
+// RemoveTask forgets the task, tasks of other sites sharing the connection stay
 func (peer *Peer) RemoveTask(task interfaces.ITask) {
-	i := func() int {
-		i := 0
-		for _, b := range peer.Tasks {
-			if b.GetSite() == task.GetSite() {
-				return i
-			}
-			i++
+	peer.Lock()
+	defer peer.Unlock()
+	for i, b := range peer.Tasks {
+		if b == task {
+			peer.Tasks = append(peer.Tasks[:i], peer.Tasks[i+1:]...)
+			return
 		}
-		return -1
-	}()
-	if i == -1 {
-		return
 	}
-	peer.Tasks = append(peer.Tasks[:i], peer.Tasks[i+1:]...)
 }
 
 func (peer *Peer) String() string {
-	return fmt.Sprintf("<Peer: %s:%d (tasks: %d)>", peer.Address, peer.Port, peer.ActiveTasks)
+	return fmt.Sprintf("<Peer: %s (tasks: %d)>", peer.HostPort(), peer.Load())
+}
+
+// HostPort returns the dialable address, with brackets around IPv6 addresses
+func (peer *Peer) HostPort() string {
+	return net.JoinHostPort(peer.Address, strconv.FormatUint(peer.Port, 10))
+}
+
+func (peer *Peer) IsOnion() bool {
+	return strings.HasSuffix(peer.Address, ".onion")
+}
+
+func (peer *Peer) IsIPv6() bool {
+	ip := net.ParseIP(peer.Address)
+	return ip != nil && ip.To4() == nil
+}
+
+// Family returns the address type the way ZeroNet names it: ipv4, ipv6 or onion
+func (peer *Peer) Family() string {
+	if peer.IsOnion() {
+		return "onion"
+	}
+	if peer.IsIPv6() {
+		return "ipv6"
+	}
+	return "ipv4"
+}
+
+// Acquire reserves a task slot on the peer unless it already runs max tasks
+func (peer *Peer) Acquire(max int) bool {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.ActiveTasks >= max {
+		return false
+	}
+	peer.ActiveTasks++
+	return true
+}
+
+// Release frees a task slot taken with Acquire
+func (peer *Peer) Release() {
+	peer.Lock()
+	defer peer.Unlock()
+	if peer.ActiveTasks > 0 {
+		peer.ActiveTasks--
+	}
+}
+
+// Load returns the number of tasks currently running on the peer
+func (peer *Peer) Load() int {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.ActiveTasks
 }
 
 func (peer *Peer) GetAddress() string {
 	return peer.Address
 }
 
-func (peer *Peer) send(request *Request) Response {
+// IsConnected tells if the connection is up, for any of the sites sharing the peer
+func (peer *Peer) IsConnected() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.State == Connected
+}
+
+func (peer *Peer) setState(state State) {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.State = state
+}
+
+func (peer *Peer) GetCertHash() string {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.CertHash
+}
+
+// IsLocal tells if the peer was found on our LAN
+func (peer *Peer) IsLocal() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.Local
+}
+
+func (peer *Peer) SetLocal() {
+	peer.Lock()
+	defer peer.Unlock()
+	peer.Local = true
+}
+
+// supportsStreamFile is false once the peer answered streamFile with an unknown command
+func (peer *Peer) supportsStreamFile() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return !peer.NoStreamFile
+}
+
+// send writes the request and waits for its answer until ctx is done or the connection fails
+func (peer *Peer) send(ctx context.Context, request *Request) (Response, error) {
+	ch := make(chan Response, 1)
 	peer.wlock.Lock()
-	request.ReqID = peer.ReqID
-	if request.Size != 0 {
-		peer.sizes[request.ReqID] = request.Size
-	}
-	data, _ := msgpack.Marshal(request)
-	peer.Connection.Write(data)
-	peer.buffers[request.ReqID] = []byte{}
-	peer.chans[request.ReqID] = make(chan Response)
+	peer.Lock()
+	if peer.State != Connected {
+		peer.Unlock()
+		peer.wlock.Unlock()
+		return Response{}, ErrNotConnected
+	}
+	id := peer.ReqID
+	request.ReqID = id
+	peer.chans[id] = ch
 	peer.ReqID++
+	peer.Unlock()
+	data, err := msgpack.Marshal(request)
+	if err == nil {
+		if deadline, ok := ctx.Deadline(); ok {
+			peer.Connection.SetWriteDeadline(deadline)
+		}
+		_, err = peer.Connection.Write(data)
+	}
 	peer.wlock.Unlock()
+	if err != nil {
+		peer.forget(id)
+		peer.closeConnection(err)
+		return Response{}, err
+	}
 	// log.WithFields(log.Fields{"request": request}).Info("Sending")
-	return <-peer.chans[request.ReqID]
+	select {
+	case answer, ok := <-ch:
+		if !ok {
+			return Response{}, ErrConnectionLost
+		}
+		return answer, nil
+	case <-ctx.Done():
+		peer.forget(id)
+		return Response{}, fmt.Errorf("%s %s: %v", peer.Address, request.Cmd, ctx.Err())
+	}
+}
+
+// forget drops a pending request, its late answer will be ignored
+func (peer *Peer) forget(id int) {
+	peer.Lock()
+	delete(peer.chans, id)
+	peer.Unlock()
+}
+
+// failPending wakes up every request still waiting for an answer
+func (peer *Peer) failPending() {
+	peer.Lock()
+	for id, ch := range peer.chans {
+		close(ch)
+		delete(peer.chans, id)
+	}
+	peer.Unlock()
 }
 
 func (peer *Peer) Stop() {
-	fmt.Println(peer.Address, "stopping")
+	log.WithFields(log.Fields{
+		"peer": peer,
+	}).Debug("Stopping peer")
+	pool.Remove(peer)
+	peer.Lock()
 	peer.Listening = false
-	if peer.Ticker != nil {
-		peer.Ticker.Stop()
+	peer.State = Disconnected
+	if peer.done != nil {
+		close(peer.done)
+		peer.done = nil
+	}
+	ticker, conn := peer.Ticker, peer.Connection
+	peer.Unlock()
+	if ticker != nil {
+		ticker.Stop()
 	}
-	if peer.Connection != nil {
-		peer.Connection.Close()
+	if conn != nil {
+		conn.Close()
 	}
+	peer.failPending()
 }
 
+// handleAnswers decodes exactly one message at a time from the connection,
+// followed by exactly stream_bytes of raw data for streamed files, and hands
+// it to the request it answers
 func (peer *Peer) handleAnswers() {
-	for {
-		if !peer.Listening {
+	reader := bufio.NewReaderSize(peer.Connection, READ_BUFF)
+	decoder := msgpack.NewDecoder(reader)
+	for peer.isListening() {
+		// wait for the next message without consuming anything, so idle timeouts are harmless
+		peer.Connection.SetReadDeadline(time.Now().Add(IDLE_TIMEOUT))
+		if _, err := reader.Peek(1); err != nil {
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				continue
+			}
+			peer.closeConnection(err)
 			return
 		}
-		dl := time.Now().Add(20 * time.Second)
-		peer.Connection.SetReadDeadline(dl)
-		// fmt.Printf("%s:%d - Set deadline: %s %v\n", peer.Address, peer.Port, dl, peer.Listening)
-		message := make([]byte, 1024*16)
-		peer.Lock()
-		_, _ = peer.Connection.Read(message)
-		peer.Unlock()
+		peer.Connection.SetReadDeadline(time.Now().Add(READ_TIMEOUT))
 		answer := Response{}
-		msgpack.Unmarshal(message, &answer)
-		// log.WithFields(log.Fields{"answer": answer}).Info("Recv")
-		// log.WithFields(log.Fields{"rq_id": request.ReqID, "answ_to": answer.To}).Info("Recv")
+		if err := decoder.Decode(&answer); err != nil {
+			if _, ok := err.(net.Error); !ok && err != io.EOF && err != io.ErrUnexpectedEOF {
+				reputation.ProtocolError(peer.Address)
+			}
+			peer.closeConnection(err)
+			return
+		}
 		if answer.StreamBytes > 0 {
-			left := answer.StreamBytes
-			buf := peer.buffers[answer.To]
-			for left > 0 {
-				peer.Lock()
-				n, err := peer.Connection.Read(message)
-				peer.Unlock()
-				if err != nil {
-					log.Warn("File streaming error: ", err)
-					break
-				}
-				left = left - n
-				buf = append(buf, message...)
+			answer.Buffer = make([]byte, answer.StreamBytes)
+			if _, err := io.ReadFull(reader, answer.Buffer); err != nil {
+				log.Warn("File streaming error: ", err)
+				peer.closeConnection(err)
+				return
 			}
-			peer.buffers[answer.To] = buf[0:int(math.Min(float64(answer.StreamBytes), float64(len(buf))))]
 		}
+		// log.WithFields(log.Fields{"answer": answer}).Info("Recv")
 		peer.Lock()
-		answer.Buffer = peer.buffers[answer.To]
+		peer.Stats.LastActivity = time.Now()
+		ch, ok := peer.chans[answer.To]
+		delete(peer.chans, answer.To)
 		peer.Unlock()
-		peer.chans[answer.To] <- answer
+		if ok {
+			ch <- answer
+		}
+	}
+}
+
+func (peer *Peer) isListening() bool {
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.Listening
+}
+
+func (peer *Peer) closeConnection(err error) {
+	if peer.isListening() {
+		log.WithFields(log.Fields{
+			"peer": peer,
+			"err":  err,
+		}).Debug("Connection lost")
 	}
+	peer.Stop()
 }
 
-func (peer *Peer) Download(task interfaces.ITask) ([]byte, error) {
+// Download fetches the whole file of the task, every chunk request gets REQUEST_TIMEOUT
+func (peer *Peer) Download(ctx context.Context, task interfaces.ITask) ([]byte, error) {
 	var res error = nil
 	if task.GetStarted() {
 		res = errors.New("Parallel")
 	}
 	task.Start()
-	peer.ActiveTasks++
+	peer.Lock()
 	peer.Tasks = append(peer.Tasks, task)
-	filename := path.Join(utils.GetDataPath(), task.GetSite(), task.GetFilename())
-	os.MkdirAll(path.Dir(filename), 0777)
+	peer.Unlock()
+	var err error
+	var received int
+	started := time.Now()
+	if peer.supportsStreamFile() {
+		received, err = peer.streamFile(ctx, task)
+		if err != nil && !task.GetDone() && ctx.Err() == nil && peer.IsConnected() {
+			log.WithFields(log.Fields{
+				"peer": peer,
+				"task": task,
+				"err":  err,
+			}).Debug("streamFile rejected, falling back to getFile")
+			task.Reset()
+			task.Start()
+			received, err = peer.getFile(ctx, task)
+		}
+	} else {
+		received, err = peer.getFile(ctx, task)
+	}
+	peer.RemoveTask(task)
+	if err != nil {
+		if ctx.Err() == nil {
+			peer.recordError()
+		}
+		log.Warnf("Download error: %s %v", task, err)
+		// leave the task for another peer
+		task.Reset()
+		return nil, err
+	}
+	if !task.Check() {
+		log.Warnf("Hash error: %s from %s", task, peer)
+		peer.recordError()
+		if reputation.HashError(peer.Address) {
+			peer.Stop()
+		}
+		// leave the task for another peer
+		task.Reset()
+		return nil, fmt.Errorf("hash error: %s", task.GetFilename())
+	}
+	peer.recordDownload(received, time.Since(started))
+	task.Finish()
+	return task.GetContent(), res
+}
+
+// streamFile requests the file with raw bytes sent after each answer
+func (peer *Peer) streamFile(ctx context.Context, task interfaces.ITask) (int, error) {
 	location := 0
-	request := Request{
-		Cmd: "streamFile",
-		Params: RequestFile{
-			Site:      task.GetSite(),
-			InnerPath: task.GetFilename(),
-			Location:  location,
-		},
-		Size: task.GetSize(),
-	}
-	message := peer.send(&request)
-	content := message.Buffer
-	task.AppendContent(message.Buffer, location)
-	s := int(peer.sizes[request.ReqID])
-	l := len(content)
-	if task.GetSize() != 0 && l != int(s) {
-		for location+l < s && !task.GetDone() {
-			log.Warn(task, len(message.Buffer), peer.sizes[request.ReqID])
-			l = len(content)
-			location += l
-			request.Params = RequestFile{
+	for !task.GetDone() {
+		request := Request{
+			Cmd: "streamFile",
+			Params: RequestFile{
 				Site:      task.GetSite(),
 				InnerPath: task.GetFilename(),
 				Location:  location,
+			},
+		}
+		message, err := peer.request(ctx, &request)
+		if err != nil {
+			return location, err
+		}
+		if message.Error != "" {
+			if strings.HasPrefix(message.Error, "Unknown cmd") {
+				peer.Lock()
+				peer.NoStreamFile = true
+				peer.Unlock()
 			}
-			message = peer.send(&request)
-			task.AppendContent(message.Buffer, location)
+			return location, fmt.Errorf("streamFile error: %s", message.Error)
+		}
+		task.AppendContent(message.Buffer, location)
+		location += len(message.Buffer)
+		if len(message.Buffer) == 0 || location >= fileSize(message, task) {
+			return location, nil
 		}
 	}
-	if len(content) == 0 {
-		if !task.Check() {
-			log.Warnf("Hash error: %s", task)
+	return location, nil
+}
+
+// getFile requests the file in chunks with the bytes inside the answer body,
+// following location until the reported size is reached
+func (peer *Peer) getFile(ctx context.Context, task interfaces.ITask) (int, error) {
+	location := 0
+	for !task.GetDone() {
+		request := Request{
+			Cmd: "getFile",
+			Params: RequestFile{
+				Site:      task.GetSite(),
+				InnerPath: task.GetFilename(),
+				Location:  location,
+			},
+		}
+		message, err := peer.request(ctx, &request)
+		if err != nil {
+			return location, err
+		}
+		if message.Error != "" {
+			return location, fmt.Errorf("getFile error: %s", message.Error)
+		}
+		task.AppendContent([]byte(message.Body), location)
+		next := message.Location
+		if next == 0 {
+			next = location + len(message.Body)
+		}
+		if next <= location {
+			reputation.ProtocolError(peer.Address)
+			return location, fmt.Errorf("getFile error: no progress at %d", location)
+		}
+		location = next
+		if location >= fileSize(message, task) {
+			return location, nil
 		}
 	}
-	task.Finish()
-	peer.RemoveTask(task)
-	peer.ActiveTasks--
-	return task.GetContent(), res
+	return location, nil
 }
 
-func (peer *Peer) Ping() {
+func fileSize(message Response, task interfaces.ITask) int {
+	if message.Size != 0 {
+		return message.Size
+	}
+	return int(task.GetSize())
+}
+
+// request sends a single request limited by REQUEST_TIMEOUT,
+// peers running out of it get a bad mark unless we gave up first
+func (peer *Peer) request(ctx context.Context, request *Request) (Response, error) {
+	timeout, cancel := context.WithTimeout(ctx, REQUEST_TIMEOUT)
+	defer cancel()
+	answer, err := peer.send(timeout, request)
+	if err != nil && timeout.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+		if reputation.Timeout(peer.Address) {
+			peer.Stop()
+		}
+	}
+	return answer, err
+}
+
+func (peer *Peer) Ping(ctx context.Context) error {
 	ping := Request{
 		Cmd:    "ping",
 		Params: map[string]string{},
 	}
-	pong := peer.send(&ping)
-	if pong.Body == "Pong!" {
-		// fmt.Println("Ping successfull")
+	started := time.Now()
+	pong, err := peer.request(ctx, &ping)
+	if err != nil {
+		return err
+	}
+	if pong.Body != "Pong!" {
+		return fmt.Errorf("Bad ping answer: %s", pong.Body)
+	}
+	peer.recordRTT(time.Since(started))
+	return nil
+}
+
+// NewHandshake builds our side of the handshake addressed to targetIP
+func NewHandshake(targetIP string) Handshake {
+	port := utils.GetFileserverPort()
+	return Handshake{
+		Version:        utils.VERSION,
+		Rev:            utils.REV,
+		Protocol:       "v2",
+		PeerID:         utils.GetPeerID(),
+		FileserverPort: port,
+		PortOpened:     port != 0,
+		TargetIP:       targetIP,
+		CryptSupported: CryptList{"tls-rsa"},
+		Crypt:          "tls-rsa",
 	}
 }
 
-func (peer *Peer) Handshake() Response {
+func (peer *Peer) Handshake(ctx context.Context) (Response, error) {
 	hs := Request{
-		Cmd: "handshake",
-		Params: Handshake{
-			Version:        utils.VERSION,
-			Rev:            utils.REV,
-			Protocol:       "v2",
-			PeerID:         utils.GetPeerID(),
-			FileserverPort: 0,
-			PortOpened:     false,
-			TargetIP:       peer.Address,
-			CryptSupported: true,
-			Crypt:          "tls-rsa",
-		},
+		Cmd:    "handshake",
+		Params: NewHandshake(peer.Address),
+	}
+	message, err := peer.request(ctx, &hs)
+	if err != nil {
+		return message, err
+	}
+	if message.Error != "" {
+		return message, fmt.Errorf("handshake error: %s", message.Error)
+	}
+	if message.Protocol != PROTOCOL {
+		return message, ErrIncompatible
+	}
+	if message.PeerID == utils.GetPeerID() {
+		return message, ErrSelf
+	}
+	peer.Lock()
+	peer.Remote = message.Handshake
+	peer.Unlock()
+	utils.SetExternalIP(message.TargetIP, peer.Address)
+	return message, nil
+}
+
+// CheckPin makes sure the peer showed the certificate pinned by a zero://host#pin:port address
+func (peer *Peer) CheckPin(pin string) error {
+	if pin == "" {
+		return nil
+	}
+	if hash := peer.GetCertHash(); hash == "" || hash != strings.ToLower(pin) {
+		return ErrCertPin
 	}
-	return peer.send(&hs)
+	return nil
 }
 
+// Connect opens the connection, unless another site sharing the peer already did
 func (peer *Peer) Connect() error {
-	peer.State = Connecting
+	return peer.ConnectPinned("")
+}
+
+// ConnectPinned is Connect for zero://host#pin:port addresses, a certificate not matching
+// the pin drops the connection before any ZeroNet message is sent
+func (peer *Peer) ConnectPinned(pin string) error {
+	if peer.IsOnion() && !utils.HasProxy() {
+		return ErrOnionNoProxy
+	}
+	peer.connectLock.Lock()
+	defer peer.connectLock.Unlock()
+	if peer.IsConnected() {
+		return nil
+	}
+	peer.setState(Connecting)
 	certFilename := path.Join(utils.GetDataPath(), "cert-rsa.pem")
 	keyFilename := path.Join(utils.GetDataPath(), "key-rsa.pem")
 	cert, _ := tls.LoadX509KeyPair(certFilename, keyFilename)
-	conn, err := tls.DialWithDialer(&net.Dialer{
-		Deadline: time.Now().Add(10 * time.Second),
-		Timeout:  time.Second * 5,
-		Cancel:   peer.Cancel,
-	}, "tcp", fmt.Sprintf("%s:%d",
-		peer.Address,
-		peer.Port), &tls.Config{
+	raw, err := utils.Dial("tcp", peer.HostPort(), 10*time.Second)
+	if err != nil {
+		peer.setState(Disconnected)
+		return err
+	}
+	conn := tls.Client(raw, &tls.Config{
 		InsecureSkipVerify: true,
 		Certificates:       []tls.Certificate{cert},
 		CipherSuites: []uint16{
@@ -280,28 +657,58 @@ func (peer *Peer) Connect() error {
 			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 		},
 	})
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	err = conn.Handshake()
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		peer.setState(Disconnected)
+		raw.Close()
+	}
 	if err == nil {
+		hash := ""
+		if certs := conn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			hash = fmt.Sprintf("%x", sha256.Sum256(certs[0].Raw))
+		}
+		peer.Lock()
+		peer.CertHash = hash
+		peer.Unlock()
+		if err = peer.CheckPin(pin); err != nil {
+			peer.setState(Disconnected)
+			conn.Close()
+			return err
+		}
+		done := make(chan struct{})
+		peer.Lock()
 		peer.Connection = conn
 		peer.State = Connected
+		peer.Listening = true
+		peer.done = done
+		peer.Stats.LastActivity = time.Now()
+		peer.Unlock()
 		go func() {
 			peer.handleAnswers()
 		}()
-		peer.Handshake()
-		peer.Ticker = time.NewTicker(time.Second * 5)
-		// go func() {
-		// 	for _ = range peer.Ticker.C {
-		// 		if peer.Listening {
-		// 			peer.Ping()
-		// 		} else {
-		// 			return
-		// 		}
-		// 	}
-		// }()
+		if _, err = peer.Handshake(context.Background()); err != nil {
+			peer.Stop()
+			return err
+		}
+		ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+		peer.Lock()
+		if peer.done != done {
+			// stopped meanwhile
+			peer.Unlock()
+			ticker.Stop()
+			return ErrNotConnected
+		}
+		peer.Ticker = ticker
+		peer.Unlock()
+		go peer.keepalive(ticker, done)
+		pool.Add(peer)
 	}
 	return err
 }
 
-func NewPeer(info io.Reader, ch chan *Peer) *Peer {
+func NewPeer(info io.Reader) *Peer {
 	addr := [4]byte{}
 	port := [2]byte{}
 	binary.Read(info, binary.BigEndian, &addr)
@@ -309,17 +716,44 @@ func NewPeer(info io.Reader, ch chan *Peer) *Peer {
 	if port[0] == 0 && port[1] == 0 {
 		return nil
 	}
+	address := fmt.Sprintf("%d.%d.%d.%d", addr[0], addr[1], addr[2], addr[3])
+	return newPeer(address, binary.BigEndian.Uint64([]byte{0, 0, 0, 0, 0, 0, port[0], port[1]}))
+}
+
+// NewPeerIPv6 reads an 18 bytes compact IPv6 entry as returned by trackers
+func NewPeerIPv6(info io.Reader) *Peer {
+	addr := [16]byte{}
+	var port uint16
+	binary.Read(info, binary.BigEndian, &addr)
+	binary.Read(info, binary.BigEndian, &port)
+	if port == 0 {
+		return nil
+	}
+	return newPeer(net.IP(addr[:]).String(), uint64(port))
+}
+
+// NewPeerFromAddress creates a peer from an IP, hostname or onion address
+func NewPeerFromAddress(address string, port int) *Peer {
+	address = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+	if address == "" || port <= 0 || port > 65535 {
+		return nil
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		address = ip.String()
+	} else {
+		address = strings.ToLower(address)
+	}
+	return newPeer(address, uint64(port))
+}
+
+func newPeer(address string, port uint64) *Peer {
 	peer := Peer{
 		State:       Disconnected,
-		Cancel:      make(chan struct{}),
 		Listening:   true,
-		Address:     fmt.Sprintf("%d.%d.%d.%d", addr[0], addr[1], addr[2], addr[3]),
-		Port:        binary.BigEndian.Uint64([]byte{0, 0, 0, 0, 0, 0, port[0], port[1]}),
-		buffers:     map[int][]byte{},
-		sizes:       map[int]int64{},
+		Address:     address,
+		Port:        port,
 		chans:       map[int]chan Response{},
 		ActiveTasks: 0,
-		Free:        ch,
 		wlock:       &sync.Mutex{},
 		ReqID:       r.Intn(1000),
 	}
@@ -0,0 +1,162 @@
+package peer
+
+import (
+	"context"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// PexPeers holds packed peers of every address family, as sent in pex
+type PexPeers struct {
+	IPv4  [][]byte
+	IPv6  [][]byte
+	Onion [][]byte
+}
+
+// NewPexPeers returns empty lists, ZeroNet peers don't accept nil ones
+func NewPexPeers() PexPeers {
+	return PexPeers{
+		IPv4:  [][]byte{},
+		IPv6:  [][]byte{},
+		Onion: [][]byte{},
+	}
+}
+
+type RequestPex struct {
+	Site       string   `msgpack:"site"`
+	Peers      [][]byte `msgpack:"peers"`
+	PeersIPv6  [][]byte `msgpack:"peers_ipv6"`
+	PeersOnion [][]byte `msgpack:"peers_onion"`
+	Need       int      `msgpack:"need"`
+}
+
+// Pex sends our known peers of the site and returns the packed peers the remote knows
+func (peer *Peer) Pex(ctx context.Context, site string, peers PexPeers, need int) (PexPeers, error) {
+	request := Request{
+		Cmd: "pex",
+		Params: RequestPex{
+			Site:       site,
+			Peers:      peers.IPv4,
+			PeersIPv6:  peers.IPv6,
+			PeersOnion: peers.Onion,
+			Need:       need,
+		},
+	}
+	message, err := peer.request(ctx, &request)
+	if err != nil {
+		return PexPeers{}, err
+	}
+	if message.Error != "" {
+		return PexPeers{}, fmt.Errorf("pex error: %s", message.Error)
+	}
+	return PexPeers{
+		IPv4:  message.Peers.Packed,
+		IPv6:  message.PeersIPv6,
+		Onion: message.PeersOnion,
+	}, nil
+}
+
+// Add packs the peer into the list of its address family
+func (pp *PexPeers) Add(p *Peer) error {
+	if p.IsOnion() {
+		packed, err := PackOnion(p.Address, int(p.Port))
+		if err != nil {
+			return err
+		}
+		pp.Onion = append(pp.Onion, packed)
+		return nil
+	}
+	packed, err := PackAddress(p.Address, int(p.Port))
+	if err != nil {
+		return err
+	}
+	if len(packed) == 6 {
+		pp.IPv4 = append(pp.IPv4, packed)
+	} else {
+		pp.IPv6 = append(pp.IPv6, packed)
+	}
+	return nil
+}
+
+func (pp PexPeers) Len() int {
+	return len(pp.IPv4) + len(pp.IPv6) + len(pp.Onion)
+}
+
+// Unpack returns peers for every valid packed address
+func (pp PexPeers) Unpack() []*Peer {
+	peers := []*Peer{}
+	for _, packed := range append(pp.IPv4, pp.IPv6...) {
+		if p := NewPeerFromPacked(packed); p != nil {
+			peers = append(peers, p)
+		}
+	}
+	for _, packed := range pp.Onion {
+		address, port, err := UnpackOnion(packed)
+		if err == nil && port != 0 {
+			peers = append(peers, newPeer(address, uint64(port)))
+		}
+	}
+	return peers
+}
+
+// PackAddress packs ip:port the way ZeroNet does in pex:
+// 4 or 16 bytes of address followed by the little endian port
+func PackAddress(address string, port int) ([]byte, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("can't pack address: %s", address)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	packed := make([]byte, len(ip)+2)
+	copy(packed, ip)
+	binary.LittleEndian.PutUint16(packed[len(ip):], uint16(port))
+	return packed, nil
+}
+
+func UnpackAddress(packed []byte) (string, int, error) {
+	if len(packed) != 6 && len(packed) != 18 {
+		return "", 0, errors.New("bad packed address length")
+	}
+	n := len(packed) - 2
+	ip := net.IP(packed[0:n]).String()
+	port := int(binary.LittleEndian.Uint16(packed[n:]))
+	return ip, port, nil
+}
+
+// PackOnion packs an onion address as its decoded base32 part followed by the little endian port
+func PackOnion(address string, port int) ([]byte, error) {
+	name := strings.ToUpper(strings.TrimSuffix(address, ".onion"))
+	raw, err := base32.StdEncoding.DecodeString(name)
+	if err != nil {
+		return nil, fmt.Errorf("can't pack onion address %s: %v", address, err)
+	}
+	packed := make([]byte, len(raw)+2)
+	copy(packed, raw)
+	binary.LittleEndian.PutUint16(packed[len(raw):], uint16(port))
+	return packed, nil
+}
+
+func UnpackOnion(packed []byte) (string, int, error) {
+	if len(packed) < 3 {
+		return "", 0, errors.New("bad packed onion length")
+	}
+	n := len(packed) - 2
+	name := base32.StdEncoding.EncodeToString(packed[0:n])
+	address := strings.ToLower(strings.TrimRight(name, "=")) + ".onion"
+	port := int(binary.LittleEndian.Uint16(packed[n:]))
+	return address, port, nil
+}
+
+func NewPeerFromPacked(packed []byte) *Peer {
+	address, port, err := UnpackAddress(packed)
+	if err != nil || port == 0 {
+		return nil
+	}
+	return newPeer(address, uint64(port))
+}
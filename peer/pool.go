@@ -0,0 +1,68 @@
+package peer
+
+import "sync"
+
+// Pool holds the connections shared by every site, one per address and port
+type Pool struct {
+	peers map[string]*Peer
+	sync.Mutex
+}
+
+var pool = &Pool{
+	peers: map[string]*Peer{},
+}
+
+func GetPool() *Pool {
+	return pool
+}
+
+// Shared returns the pooled peer with the same address, or p if there is none.
+// Peers only join the pool once connected, so unreachable ones don't pile up in it.
+func Shared(p *Peer) *Peer {
+	if existing, ok := pool.Get(p.HostPort()); ok {
+		return existing
+	}
+	return p
+}
+
+func (pool *Pool) Add(p *Peer) *Peer {
+	pool.Lock()
+	defer pool.Unlock()
+	if existing, ok := pool.peers[p.HostPort()]; ok {
+		return existing
+	}
+	pool.peers[p.HostPort()] = p
+	return p
+}
+
+func (pool *Pool) Get(hostPort string) (*Peer, bool) {
+	pool.Lock()
+	defer pool.Unlock()
+	p, ok := pool.peers[hostPort]
+	return p, ok
+}
+
+// Remove forgets a dead peer, so the next site asking for it gets a fresh connection
+func (pool *Pool) Remove(p *Peer) {
+	pool.Lock()
+	defer pool.Unlock()
+	if pool.peers[p.HostPort()] == p {
+		delete(pool.peers, p.HostPort())
+	}
+}
+
+func (pool *Pool) Peers() []*Peer {
+	pool.Lock()
+	defer pool.Unlock()
+	peers := []*Peer{}
+	for _, p := range pool.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+func (pool *Pool) Len() int {
+	pool.Lock()
+	defer pool.Unlock()
+	return len(pool.peers)
+}
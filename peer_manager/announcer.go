@@ -0,0 +1,174 @@
+package peer_manager
+
+import (
+	"crypto/sha1"
+	"net"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/dht"
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/reputation"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	EVENT_NONE      = ""
+	EVENT_STARTED   = "started"
+	EVENT_COMPLETED = "completed"
+	EVENT_STOPPED   = "stopped"
+)
+
+// re-announce interval for trackers not telling theirs
+const ANNOUNCE_INTERVAL = 20 * time.Minute
+
+// never re-announce more often than that, whatever the tracker says
+const MIN_ANNOUNCE_INTERVAL = 2 * time.Minute
+
+// how often the announcer looks for trackers due
+const ANNOUNCE_CHECK_INTERVAL = 30 * time.Second
+
+// the DHT is scheduled with the trackers under that name
+const DHT_TRACKER = "dht"
+
+const DHT_ANNOUNCE_INTERVAL = 15 * time.Minute
+
+// scheduleAnnounce sets the next announce to the tracker after the interval it asked for
+func (pm *PeerManager) scheduleAnnounce(tracker string, interval time.Duration) {
+	if interval <= 0 {
+		interval = ANNOUNCE_INTERVAL
+	}
+	if interval < MIN_ANNOUNCE_INTERVAL {
+		interval = MIN_ANNOUNCE_INTERVAL
+	}
+	pm.Lock()
+	pm.nextAnnounce[tracker] = time.Now().Add(interval)
+	pm.Unlock()
+}
+
+// reannounce keeps announcing the site to every tracker when it's due,
+// so we keep finding peers while the first ones go away. It saves the good ones to the peer cache too.
+func (pm *PeerManager) reannounce(stop chan struct{}) {
+	ticker := time.NewTicker(ANNOUNCE_CHECK_INTERVAL)
+	defer ticker.Stop()
+	save := time.NewTicker(PEER_CACHE_SAVE_INTERVAL)
+	defer save.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-save.C:
+			pm.SavePeers()
+			continue
+		case <-ticker.C:
+		}
+		// peers lost or slots freed by other sites since the last check
+		pm.ConnectStatic()
+		pm.fill()
+		now := time.Now()
+		due := []string{}
+		pm.Lock()
+		for _, tracker := range append([]string{DHT_TRACKER}, pm.Trackers...) {
+			if next, ok := pm.nextAnnounce[tracker]; ok && now.After(next) {
+				// don't pick it again while the announce is running
+				pm.nextAnnounce[tracker] = now.Add(ANNOUNCE_INTERVAL)
+				due = append(due, tracker)
+			}
+		}
+		pm.Unlock()
+		for _, tracker := range due {
+			if tracker == DHT_TRACKER {
+				go pm.announceDHT()
+			} else {
+				go pm.announceTo(tracker, EVENT_NONE, false)
+			}
+		}
+	}
+}
+
+// announceDHT looks the site up in the DHT, announcing us too when others can connect
+func (pm *PeerManager) announceDHT() {
+	node := dht.GetNode()
+	if node == nil {
+		return
+	}
+	infoHash := dht.ID(sha1.Sum([]byte(pm.Address)))
+	var addrs []*net.UDPAddr
+	if port := utils.GetFileserverPort(); port != 0 {
+		addrs = node.Announce(infoHash, port)
+	} else {
+		addrs = node.GetPeers(infoHash)
+	}
+	pm.scheduleAnnounce(DHT_TRACKER, DHT_ANNOUNCE_INTERVAL)
+	c := 0
+	for _, addr := range addrs {
+		p := peer.NewPeerFromAddress(addr.IP.String(), addr.Port)
+		if p == nil || reputation.IsBanned(p.Address) {
+			continue
+		}
+		if pm.AddPeer(p) {
+			c++
+		}
+	}
+	log.WithFields(log.Fields{
+		"site":  pm.Address,
+		"peers": c,
+	}).Debug("New DHT peers added")
+}
+
+// Completed tells the trackers once the site is fully downloaded
+func (pm *PeerManager) Completed() {
+	pm.Lock()
+	if pm.completed || pm.stopAnnounce == nil {
+		pm.Unlock()
+		return
+	}
+	pm.completed = true
+	trackers := pm.Trackers
+	pm.Unlock()
+	pm.SavePeers()
+	for _, tracker := range trackers {
+		go pm.announceTo(tracker, EVENT_COMPLETED, false)
+	}
+}
+
+// StopAnnounce ends the re-announces and tells the trackers we are gone
+func (pm *PeerManager) StopAnnounce() {
+	pm.Lock()
+	if pm.stopAnnounce == nil {
+		pm.Unlock()
+		return
+	}
+	close(pm.stopAnnounce)
+	pm.stopAnnounce = nil
+	trackers := pm.Trackers
+	pm.Unlock()
+	budget.Unregister(pm)
+	pm.SavePeers()
+	log.WithFields(log.Fields{
+		"site": pm.Address,
+	}).Debug("Announce stopped")
+	for _, tracker := range trackers {
+		go pm.announceTo(tracker, EVENT_STOPPED, false)
+	}
+}
+
+// AddUploaded counts bytes of the site we served to others
+func (pm *PeerManager) AddUploaded(bytes int) {
+	pm.Lock()
+	pm.uploaded += int64(bytes)
+	pm.Unlock()
+}
+
+// transfer returns the uploaded, downloaded and left byte counts reported to trackers
+func (pm *PeerManager) transfer() (int64, int64, int64) {
+	pm.Lock()
+	uploaded := pm.uploaded
+	progress := pm.Progress
+	pm.Unlock()
+	if progress == nil {
+		return uploaded, 0, 0
+	}
+	downloaded, left := progress()
+	return uploaded, downloaded, left
+}
@@ -0,0 +1,192 @@
+package peer_manager
+
+import (
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	log "github.com/Sirupsen/logrus"
+)
+
+// open peer connections of every site together
+const MAX_CONNECTIONS = 100
+
+// most peers a single site keeps connected
+const MAX_SITE_WORKERS = 20
+
+// a site gets at least that many connections however many sites run
+const MIN_SITE_WORKERS = 3
+
+// connection attempts in flight at once
+const MAX_CONNECTING = 10
+
+// found peers kept per site while waiting for a connection slot
+const MAX_PENDING = 200
+
+// connections without traffic for that long may be closed to make room for another site
+const IDLE_CONNECTION = 30 * time.Second
+
+// Budget shares the connections between the running sites
+type Budget struct {
+	managers   map[*PeerManager]bool
+	opening    int
+	inbound    int
+	connecting chan struct{}
+	sync.Mutex
+}
+
+var budget = &Budget{
+	managers:   map[*PeerManager]bool{},
+	connecting: make(chan struct{}, MAX_CONNECTING),
+}
+
+func GetBudget() *Budget {
+	return budget
+}
+
+func (b *Budget) Register(pm *PeerManager) {
+	b.Lock()
+	b.managers[pm] = true
+	b.Unlock()
+}
+
+func (b *Budget) Unregister(pm *PeerManager) {
+	b.Lock()
+	delete(b.managers, pm)
+	b.Unlock()
+}
+
+// FairShare is the number of connections every running site may hold
+func (b *Budget) FairShare() int {
+	b.Lock()
+	sites := len(b.managers)
+	b.Unlock()
+	if sites == 0 {
+		sites = 1
+	}
+	share := MAX_CONNECTIONS / sites
+	if share < MIN_SITE_WORKERS {
+		share = MIN_SITE_WORKERS
+	}
+	if share > MAX_SITE_WORKERS {
+		share = MAX_SITE_WORKERS
+	}
+	return share
+}
+
+// Open counts the connected peers of every site and the connections peers opened to us
+func (b *Budget) Open() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.open()
+}
+
+// open must be called with the budget locked
+func (b *Budget) open() int {
+	c := b.inbound
+	for _, p := range peer.GetPool().Peers() {
+		if p.IsConnected() {
+			c++
+		}
+	}
+	return c
+}
+
+// reserve takes a slot for a new connection of the site, closing an idle one of a greedier site if we are at the limit.
+// The slot has to be given back with release once the connection is open or failed.
+func (b *Budget) reserve(pm *PeerManager) bool {
+	// the slot freed by closeIdle may be taken by someone else first, check again then
+	for !b.take(&b.opening) {
+		if !b.closeIdle(pm) {
+			return false
+		}
+	}
+	b.connecting <- struct{}{}
+	return true
+}
+
+// take counts one more connection in counter if we are below the limit, checked and counted under one lock
+func (b *Budget) take(counter *int) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.open()+b.opening >= MAX_CONNECTIONS {
+		return false
+	}
+	*counter++
+	return true
+}
+
+func (b *Budget) release() {
+	<-b.connecting
+	b.Lock()
+	b.opening--
+	b.Unlock()
+}
+
+// ReserveInbound counts a connection a peer opened to our file server, closing an idle one of ours
+// if we are at the limit. Returns false if there is no room, the connection has to be refused then.
+func (b *Budget) ReserveInbound() bool {
+	for !b.take(&b.inbound) {
+		if !b.closeIdle(nil) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *Budget) ReleaseInbound() {
+	b.Lock()
+	b.inbound--
+	b.Unlock()
+}
+
+// closeIdle closes the worst idle connection nobody needs: held by no running site,
+// or only by sites above their fair share, and not by the site asking, nil for the file server
+func (b *Budget) closeIdle(pm *PeerManager) bool {
+	share := b.FairShare()
+	b.Lock()
+	managers := []*PeerManager{}
+	for m := range b.managers {
+		managers = append(managers, m)
+	}
+	b.Unlock()
+	// sites each connection is in use by
+	holders := map[*peer.Peer][]*PeerManager{}
+	for _, m := range managers {
+		for _, p := range m.GetActivePeers() {
+			holders[p] = append(holders[p], m)
+		}
+	}
+	var victim *peer.Peer
+	for _, p := range peer.GetPool().Peers() {
+		if !p.IsConnected() || p.IsLocal() || p.Static || p.Load() > 0 || p.Idle() < IDLE_CONNECTION {
+			continue
+		}
+		needed := false
+		for _, m := range holders[p] {
+			if m == pm || m.Workers() <= share {
+				needed = true
+				break
+			}
+		}
+		if needed {
+			continue
+		}
+		if victim == nil || p.Score() < victim.Score() {
+			victim = p
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	site := "file server"
+	if pm != nil {
+		site = pm.Address
+	}
+	log.WithFields(log.Fields{
+		"peer": victim,
+		"site": site,
+	}).Debug("Closing idle connection for another site")
+	victim.Stop()
+	return true
+}
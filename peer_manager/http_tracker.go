@@ -0,0 +1,120 @@
+package peer_manager
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+	"github.com/google/go-querystring/query"
+	bencode "github.com/jackpal/bencode-go"
+)
+
+// TrackerResponse is a decoded http tracker announce reply
+type TrackerResponse struct {
+	Peers       Peers
+	Interval    time.Duration
+	MinInterval time.Duration
+	// seeders and leechers, -1 when the tracker didn't tell
+	Complete   int
+	Incomplete int
+	Warning    string
+}
+
+// NextAnnounce returns when the tracker wants to hear from us again, honouring min interval
+func (res TrackerResponse) NextAnnounce() time.Duration {
+	if res.MinInterval > res.Interval {
+		return res.MinInterval
+	}
+	return res.Interval
+}
+
+func (pm *PeerManager) announceHTTP(tracker string, event string) (TrackerResponse, error) {
+	params, _ := query.Values(pm.NewAnnounce(event))
+	url := fmt.Sprintf("%s?%s", tracker, params.Encode())
+	log.WithFields(log.Fields{
+		"tracker": tracker,
+		"params":  params,
+	}).Debug("Announce HTTP tracker")
+	resp, err := utils.GetHTTPClient().Get(url)
+	if err != nil {
+		return TrackerResponse{}, err
+	}
+	defer resp.Body.Close()
+	raw, err := bencode.Decode(resp.Body)
+	if err != nil {
+		if resp.StatusCode != 200 {
+			return TrackerResponse{}, fmt.Errorf("Tracker error: HTTP %d", resp.StatusCode)
+		}
+		return TrackerResponse{}, err
+	}
+	data, ok := raw.(map[string]interface{})
+	if !ok {
+		return TrackerResponse{}, fmt.Errorf("Bad tracker answer")
+	}
+	res, err := decodeTrackerResponse(data)
+	if res.Warning != "" {
+		log.WithFields(log.Fields{
+			"tracker": tracker,
+			"warning": res.Warning,
+		}).Warn("Tracker warning")
+	}
+	return res, err
+}
+
+// decodeTrackerResponse reads a bencoded announce reply, peers may come compact or as a list of dicts
+func decodeTrackerResponse(data map[string]interface{}) (TrackerResponse, error) {
+	if reason, ok := data["failure reason"].(string); ok {
+		return TrackerResponse{}, fmt.Errorf("Tracker error: %s", reason)
+	}
+	res := TrackerResponse{
+		Peers:       Peers{},
+		Interval:    time.Duration(bencodeInt(data["interval"], 0)) * time.Second,
+		MinInterval: time.Duration(bencodeInt(data["min interval"], 0)) * time.Second,
+		Complete:    int(bencodeInt(data["complete"], -1)),
+		Incomplete:  int(bencodeInt(data["incomplete"], -1)),
+	}
+	res.Warning, _ = data["warning message"].(string)
+	switch peers := data["peers"].(type) {
+	case string:
+		reader := bytes.NewReader([]byte(peers))
+		for i := 0; i < len(peers)/6; i++ {
+			if p := peer.NewPeer(reader); p != nil {
+				res.Peers = append(res.Peers, p)
+			}
+		}
+	case []interface{}:
+		for _, item := range peers {
+			dict, ok := item.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ip, _ := dict["ip"].(string)
+			port := bencodeInt(dict["port"], 0)
+			if ip == "" || port <= 0 || port > 65535 {
+				continue
+			}
+			if p := peer.NewPeerFromAddress(ip, int(port)); p != nil {
+				res.Peers = append(res.Peers, p)
+			}
+		}
+	}
+	if peers6, ok := data["peers6"].(string); ok {
+		reader := bytes.NewReader([]byte(peers6))
+		for i := 0; i < len(peers6)/18; i++ {
+			if p := peer.NewPeerIPv6(reader); p != nil {
+				res.Peers = append(res.Peers, p)
+			}
+		}
+	}
+	return res, nil
+}
+
+func bencodeInt(v interface{}, def int64) int64 {
+	if i, ok := v.(int64); ok {
+		return i
+	}
+	return def
+}
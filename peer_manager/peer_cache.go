@@ -0,0 +1,145 @@
+package peer_manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+const PEER_CACHE_FILENAME = "peers.json"
+
+// cached peers not seen for that long are forgotten
+const PEER_CACHE_EXPIRE = 7 * 24 * time.Hour
+
+// max peers kept per site
+const PEER_CACHE_SIZE = 50
+
+// how often the peers of a running site are written to the cache
+const PEER_CACHE_SAVE_INTERVAL = 5 * time.Minute
+
+type CachedPeer struct {
+	Address  string    `json:"address"`
+	Port     uint64    `json:"port"`
+	LastSeen time.Time `json:"last_seen"`
+	Score    float64   `json:"score"`
+}
+
+var peerCache map[string][]CachedPeer
+var peerCacheLock sync.Mutex
+
+// loadPeerCache reads the cache file once, peerCacheLock must be held
+func loadPeerCache() {
+	if peerCache != nil {
+		return
+	}
+	peerCache = map[string][]CachedPeer{}
+	filename := path.Join(utils.GetDataPath(), PEER_CACHE_FILENAME)
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &peerCache)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't load peer cache")
+	}
+}
+
+// savePeerCache writes the cache, peerCacheLock must be held
+func savePeerCache() {
+	filename := path.Join(utils.GetDataPath(), PEER_CACHE_FILENAME)
+	content, err := json.MarshalIndent(peerCache, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filename, content, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't save peer cache")
+	}
+}
+
+// fresh drops expired peers and keeps the best PEER_CACHE_SIZE ones
+func fresh(peers []CachedPeer) []CachedPeer {
+	res := []CachedPeer{}
+	for _, p := range peers {
+		if time.Since(p.LastSeen) < PEER_CACHE_EXPIRE {
+			res = append(res, p)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Score != res[j].Score {
+			return res[i].Score > res[j].Score
+		}
+		return res[i].LastSeen.After(res[j].LastSeen)
+	})
+	if len(res) > PEER_CACHE_SIZE {
+		res = res[:PEER_CACHE_SIZE]
+	}
+	return res
+}
+
+// LoadCachedPeers connects to the peers the site had last time, without waiting for trackers
+func (pm *PeerManager) LoadCachedPeers() int {
+	peerCacheLock.Lock()
+	loadPeerCache()
+	cached := fresh(peerCache[pm.Address])
+	peerCacheLock.Unlock()
+	c := 0
+	for _, cp := range cached {
+		p := peer.NewPeerFromAddress(cp.Address, int(cp.Port))
+		if p != nil && pm.AddPeer(p) {
+			c++
+		}
+	}
+	log.WithFields(log.Fields{
+		"site":  pm.Address,
+		"peers": c,
+	}).Debug("Cached peers added")
+	return c
+}
+
+// SavePeers stores the connected peers of the site with their score, keeping the older ones until they expire
+func (pm *PeerManager) SavePeers() {
+	now := time.Now()
+	current := map[string]CachedPeer{}
+	for _, p := range pm.GetActivePeers() {
+		current[p.HostPort()] = CachedPeer{
+			Address:  p.Address,
+			Port:     p.Port,
+			LastSeen: now,
+			Score:    p.Score(),
+		}
+	}
+	peerCacheLock.Lock()
+	defer peerCacheLock.Unlock()
+	loadPeerCache()
+	peers := []CachedPeer{}
+	for _, cp := range current {
+		peers = append(peers, cp)
+	}
+	for _, cp := range peerCache[pm.Address] {
+		p := peer.NewPeerFromAddress(cp.Address, int(cp.Port))
+		if p == nil {
+			continue
+		}
+		if _, ok := current[p.HostPort()]; !ok {
+			peers = append(peers, cp)
+		}
+	}
+	peerCache[pm.Address] = fresh(peers)
+	savePeerCache()
+}
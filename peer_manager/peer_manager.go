@@ -1,23 +1,20 @@
 package peer_manager
 
 import (
-	"bytes"
 	"container/heap"
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
-	r "math/rand"
 	"net"
-	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/reputation"
 	"github.com/G1itchZero/ZeroGo/utils"
 	log "github.com/Sirupsen/logrus"
-	"github.com/google/go-querystring/query"
-	bencode "github.com/jackpal/bencode-go"
 )
 
 type Peers []*peer.Peer
@@ -29,9 +26,31 @@ type PeerManager struct {
 	Trackers   []string
 	OnPeers    chan *peer.Peer
 	OnAnnounce chan int
+	// returns the downloaded and left bytes of the site for trackers
+	Progress func() (int64, int64)
+	// found peers waiting for a connection slot, best first
+	pending      Peers
+	connecting   int
+	pexStarted   bool
+	free         *sync.Cond
+	uploaded     int64
+	completed    bool
+	stopAnnounce chan struct{}
+	nextAnnounce map[string]time.Time
 	sync.Mutex
 }
 
+// max tasks running at once on a single peer
+const MAX_PEER_TASKS = 4
+
+// peers asked and given per pex request
+const PEX_NEED = 10
+
+// keep asking connected peers for more while we know less than that
+const PEX_WANT = 30
+
+const PEX_INTERVAL = 2 * time.Minute
+
 type Announce struct {
 	InfoHash   string `url:"info_hash"`
 	PeerID     string `url:"peer_id"`
@@ -41,21 +60,26 @@ type Announce struct {
 	Left       int    `url:"left"`
 	Compact    int    `url:"compact"`
 	NumWant    int    `url:"numwant"`
-	Event      string `url:"event"`
+	Event      string `url:"event,omitempty"`
 }
 
 func NewPeerManager(address string) *PeerManager {
 	pm := PeerManager{
-		Address:    address,
-		Peers:      Peers{},
-		OnPeers:    make(chan *peer.Peer, 100),
-		OnAnnounce: make(chan int),
+		Address:      address,
+		Peers:        Peers{},
+		OnPeers:      make(chan *peer.Peer, 100),
+		OnAnnounce:   make(chan int),
+		nextAnnounce: map[string]time.Time{},
 	}
+	pm.free = sync.NewCond(&pm.Mutex)
 	heap.Init(&pm.Peers)
 	return &pm
 }
 
 func (pm *PeerManager) GetActivePeers() Peers {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.dropDisconnected()
 	peers := Peers{}
 	for _, peer := range pm.Peers {
 		peers = append(peers, peer)
@@ -73,282 +97,390 @@ func (pm *PeerManager) Stop() {
 	log.Fatal("peers stopped")
 }
 
-func (pm *PeerManager) Get() *peer.Peer {
-	for len(pm.Peers) == 0 {
-		time.Sleep(time.Duration(time.Millisecond * 100))
-	}
+// Get blocks until a peer is free and reserves it: the least busy one first,
+// then the best scored. The peer stays in the pool and must be given back with Release.
+func (pm *PeerManager) Get(ctx context.Context) *peer.Peer {
 	pm.Lock()
-	p := heap.Pop(&pm.Peers)
-	if p == nil {
-		p = pm.Get()
+	defer pm.Unlock()
+	for ctx.Err() == nil {
+		pm.dropDisconnected()
+		// loads and scores change all the time, so reorder before picking
+		heap.Init(&pm.Peers)
+		if len(pm.Peers) > 0 && pm.Peers[0].Acquire(MAX_PEER_TASKS) {
+			return pm.Peers[0]
+		}
+		pm.free.Wait()
 	}
-	pm.Count--
+	return nil
+}
+
+// Release gives a peer taken with Get back to the pool
+func (pm *PeerManager) Release(p *peer.Peer) {
+	p.Release()
+	pm.Lock()
+	pm.free.Broadcast()
+	pm.Unlock()
+	pm.notify(p)
+}
+
+// Wake makes the waiting Get calls check their context
+func (pm *PeerManager) Wake() {
+	pm.Lock()
+	pm.free.Broadcast()
 	pm.Unlock()
-	return p.(*peer.Peer)
 }
 
+// notify tells the downloader a peer is available without blocking when nobody listens
+func (pm *PeerManager) notify(p *peer.Peer) {
+	select {
+	case pm.OnPeers <- p:
+	default:
+	}
+}
+
+// dropDisconnected removes dead connections from the pool, pm must be locked
+func (pm *PeerManager) dropDisconnected() {
+	peers := Peers{}
+	for _, p := range pm.Peers {
+		if p.IsConnected() && (p.Static || !reputation.IsBanned(p.Address)) {
+			peers = append(peers, p)
+		} else {
+			pm.Count--
+		}
+	}
+	pm.Peers = peers
+}
+
+// Announce tells every tracker we started and keeps re-announcing in the background
 func (pm *PeerManager) Announce() {
+	pm.Lock()
 	pm.Trackers = utils.GetTrackers()
-	for _, tracker := range pm.Trackers {
-		go func(tracker string) {
-			peers := pm.announceTracker(tracker)
-			c := 0
-			for _, p := range peers {
-				if pm.peerIsKnown(p) {
-					continue
-				}
-				c++
-				go func(p *peer.Peer) {
-					err := pm.connectPeer(p)
-					if err != nil {
-						return
-					}
-					heap.Push(&pm.Peers, p)
-					pm.Count++
-					pm.OnPeers <- p
-				}(p)
-			}
-			pm.OnAnnounce <- c
-			log.WithFields(log.Fields{
-				"tracker": tracker,
-				"peers":   c,
-			}).Debug("New peers added")
-		}(tracker)
+	trackers := pm.Trackers
+	budget.Register(pm)
+	if pm.stopAnnounce == nil {
+		pm.stopAnnounce = make(chan struct{})
+		go pm.reannounce(pm.stopAnnounce)
+		if pm.pexStarted {
+			go pm.pexLoop(pm.stopAnnounce)
+		}
 	}
+	pm.Unlock()
+	for _, tracker := range trackers {
+		go pm.announceTo(tracker, EVENT_STARTED, true)
+	}
+	go pm.announceDHT()
 }
 
-func (pm *PeerManager) connectPeer(peer *peer.Peer) error {
-	err := peer.Connect()
-	if err == nil {
-		// log.WithFields(log.Fields{
-		// 	"peer": peer,
-		// }).Debug("Peer connected")
-		peer.Ping()
+// announceTo announces the event to the tracker and connects the peers it returns,
+// notify reports the count on OnAnnounce and waits for it to be read
+func (pm *PeerManager) announceTo(tracker string, event string, notify bool) {
+	peers, interval := pm.announceTracker(tracker, event)
+	if event != EVENT_STOPPED {
+		pm.scheduleAnnounce(tracker, interval)
+	}
+	c := 0
+	for _, p := range peers {
+		if reputation.IsBanned(p.Address) {
+			continue
+		}
+		if pm.AddPeer(p) {
+			c++
+		}
+	}
+	if notify {
+		pm.OnAnnounce <- c
 	} else {
-		// log.WithFields(log.Fields{
-		// 	"error": err,
-		// 	"peer":  peer,
-		// }).Warn("Connection error")
-		pm.removePeer(peer)
+		select {
+		case pm.OnAnnounce <- c:
+		default:
+		}
 	}
-	return err
+	log.WithFields(log.Fields{
+		"tracker": tracker,
+		"event":   event,
+		"peers":   c,
+	}).Debug("New peers added")
 }
 
-func NewAnnounce(address string, tracker string) Announce {
-	return Announce{
-		InfoHash: fmt.Sprintf("%s", sha1.Sum([]byte(address))),
-		PeerID:   utils.GetPeerID(),
-		Port:     0, //15441,
-		Uploaded: 0, Downloaded: 0,
-		Left: 0, Compact: 1, NumWant: 30,
-		Event: "started",
+// AddPeer queues a newly found peer unless it's already known,
+// it gets connected as soon as the site and the global budget have room for it
+func (pm *PeerManager) AddPeer(p *peer.Peer) bool {
+	// other sites may already hold a connection to the same peer
+	p = peer.Shared(p)
+	pm.Lock()
+	if pm.peerIsKnown(p) || len(pm.pending) >= MAX_PENDING {
+		pm.Unlock()
+		return false
 	}
+	if p.IsLocal() {
+		pm.pending = append(Peers{p}, pm.pending...)
+	} else {
+		pm.pending = append(pm.pending, p)
+	}
+	pm.Unlock()
+	pm.fill()
+	return true
 }
 
-func (pm *PeerManager) removePeer(peer *peer.Peer) {
-	i := func() int {
-		i := 0
-		for _, b := range pm.Peers {
-			if b.Address == peer.Address {
-				return i
+// WorkerLimit is the number of peers the site may keep connected
+func (pm *PeerManager) WorkerLimit() int {
+	return budget.FairShare()
+}
+
+// Workers returns the number of connected peers of the site
+func (pm *PeerManager) Workers() int {
+	return len(pm.GetActivePeers())
+}
+
+// fill connects pending peers while the site is below its worker limit
+func (pm *PeerManager) fill() {
+	limit := pm.WorkerLimit()
+	for {
+		pm.Lock()
+		pm.dropDisconnected()
+		workers := pm.connecting
+		for _, p := range pm.Peers {
+			if !p.Static {
+				workers++
 			}
-			i++
 		}
-		return -1
-	}()
-	if i == -1 {
-		return
+		if len(pm.pending) == 0 || workers >= limit {
+			pm.Unlock()
+			return
+		}
+		p := pm.pending[0]
+		pm.pending = pm.pending[1:]
+		pm.connecting++
+		pm.Unlock()
+		go pm.connect(p)
 	}
-	pm.Peers = append(pm.Peers[:i], pm.Peers[i+1:]...)
 }
 
-func (pm *PeerManager) peerIsKnown(peer *peer.Peer) bool {
-	if peer.Address == "0.0.0.0" || peer.Address == utils.GetExternalIP() || peer.Address == "9.12.0.6" {
-		return true
+// connect opens the connection of a pending peer within the global budget and adds it to the site
+func (pm *PeerManager) connect(p *peer.Peer) {
+	// another site may have connected it while it was pending
+	if shared := peer.Shared(p); shared != p {
+		if p.IsLocal() {
+			shared.SetLocal()
+		}
+		p = shared
 	}
-	for _, b := range pm.Peers {
-		if b.Address == peer.Address {
-			return true
+	if !p.IsConnected() {
+		if !budget.reserve(pm) {
+			// no room anywhere for now, the next check tries again
+			pm.Lock()
+			pm.pending = append(Peers{p}, pm.pending...)
+			pm.connecting--
+			pm.Unlock()
+			return
+		}
+		err := pm.connectPeer(p)
+		budget.release()
+		if err != nil {
+			pm.Lock()
+			pm.connecting--
+			pm.Unlock()
+			pm.fill()
+			return
 		}
 	}
-	return false
+	pm.Lock()
+	pm.connecting--
+	pm.Unlock()
+	pm.addConnected(p)
 }
 
-func (pm *PeerManager) announceHTTP(tracker string) Peers {
-	params, _ := query.Values(NewAnnounce(pm.Address, tracker))
-	url := fmt.Sprintf("%s?%s", tracker, params.Encode())
-	log.WithFields(log.Fields{
-		"tracker": tracker,
-		"params":  params,
-	}).Debug("Announce HTTP tracker")
-	resp, err := http.Get(url)
-	if err != nil {
-		log.Warn(fmt.Errorf("Announce error: %v", err))
-		return Peers{}
-	}
-	raw, err := bencode.Decode(resp.Body)
-	if err != nil {
-		log.Warn(fmt.Errorf("Announce error: %v", err))
-		return Peers{}
-	}
-	resp.Body.Close()
-	data := raw.(map[string]interface{})
-	if data["peers"] == nil {
-		return Peers{}
+// addConnected puts a connected peer in the pool of the site unless it's there already
+func (pm *PeerManager) addConnected(p *peer.Peer) {
+	pm.Lock()
+	for _, b := range pm.Peers {
+		if b.HostPort() == p.HostPort() {
+			pm.Unlock()
+			return
+		}
 	}
-	peerData, _ := utils.GetBytes(data["peers"])
-	peerReader := bytes.NewReader(peerData)
-	peerCount := len(peerData) / 6
-	peers := Peers{}
-	for i := 0; i < peerCount; i++ {
-		peer := peer.NewPeer(peerReader, pm.OnPeers)
-		if peer == nil {
+	heap.Push(&pm.Peers, p)
+	pm.Count++
+	pm.free.Broadcast()
+	pm.Unlock()
+	pm.notify(p)
+	pm.pexPeer(p)
+}
+
+// ConnectStatic connects the static peers of the site that aren't connected,
+// they don't count in the worker limit and are connected again whenever they go away
+func (pm *PeerManager) ConnectStatic() {
+	for _, address := range utils.GetStaticPeers(pm.Address) {
+		host, port, err := net.SplitHostPort(address)
+		portNum, err2 := strconv.Atoi(port)
+		if err != nil || err2 != nil {
+			log.WithFields(log.Fields{
+				"peer": address,
+			}).Warn("Bad static peer")
 			continue
 		}
-		peers = append(peers, peer)
+		p := peer.NewPeerFromAddress(host, portNum)
+		if p == nil {
+			continue
+		}
+		p = peer.Shared(p)
+		p.Static = true
+		go func(p *peer.Peer) {
+			if err := pm.connectPeer(p); err != nil {
+				log.WithFields(log.Fields{
+					"peer": p,
+					"err":  err,
+				}).Debug("Static peer unreachable")
+				return
+			}
+			pm.addConnected(p)
+		}(p)
 	}
-	return peers
 }
 
-const (
-	UDP_REQUEST_CONNECT  = 0
-	UDP_REQUEST_ANNOUNCE = 1
-)
-
-func (pm *PeerManager) connectUDPTracker(socket *net.UDPConn, serverAddr *net.UDPAddr, transactionID int32) (connectionID int64, err error) {
-	connectionID = int64(0x41727101980)
-	request := new(bytes.Buffer)
-	var data = []interface{}{
-		connectionID,
-		uint32(UDP_REQUEST_CONNECT),
-		transactionID,
+// AddLocalPeer adds a peer found on our LAN, or promotes it if we already know it
+func (pm *PeerManager) AddLocalPeer(p *peer.Peer) bool {
+	p = peer.Shared(p)
+	p.SetLocal()
+	pm.Lock()
+	known := false
+	for _, b := range pm.Peers {
+		if b == p {
+			known = true
+			break
+		}
 	}
-	for _, v := range data {
-		binary.Write(request, binary.BigEndian, v)
+	pm.Unlock()
+	if known {
+		pm.Wake()
+		return false
 	}
-	socket.WriteToUDP(request.Bytes(), serverAddr)
-	buf := make([]byte, 16)
-	_, _, err = socket.ReadFromUDP(buf)
-	if err != nil {
-		return 0, err
-	}
-	answer := bytes.NewReader(buf)
-	var action int32
-	binary.Read(answer, binary.BigEndian, &action)
-	binary.Read(answer, binary.BigEndian, &transactionID)
-	binary.Read(answer, binary.BigEndian, &connectionID)
-	return connectionID, nil
-	// fmt.Println("Received ", fmt.Sprintf("%x", buf[0:n]), " from ", addr)
-}
-
-func (pm *PeerManager) announceUDPTracker(socket *net.UDPConn, serverAddr *net.UDPAddr, transactionID int32, connectionID int64, port int32) (peers Peers, err error) {
-	peerID := []byte(utils.GetPeerID()[0:20])
-	infoHash := sha1.Sum([]byte(pm.Address))
-
-	announce := new(bytes.Buffer)
-	data := []interface{}{
-		connectionID,
-		uint32(UDP_REQUEST_ANNOUNCE),
-		transactionID,
-		infoHash,
-		peerID,
-		int64(0),
-		int64(0),
-		int64(0),
-		int32(2),
-		int32(0),
-		int32(0),
-		int32(50),
-		int16(port),
-	}
-
-	for _, v := range data {
-		binary.Write(announce, binary.BigEndian, v)
+	return pm.AddPeer(p)
+}
+
+func (pm *PeerManager) connectPeer(p *peer.Peer) error {
+	if p.IsConnected() {
+		return nil
 	}
-	log.WithFields(log.Fields{
-		"tracker": serverAddr.String(),
-		"params":  fmt.Sprintf("%x", announce.Bytes()),
-	}).Debug("Announce UDP tracker")
-	socket.WriteToUDP(announce.Bytes(), serverAddr)
-	buf2 := make([]byte, 10240)
-	n, _, err := socket.ReadFromUDP(buf2)
-	buf2 = buf2[0:n]
-	if err != nil {
-		// fmt.Println("Error: ", err)
-		return Peers{}, err
-	}
-	answer := bytes.NewReader(buf2)
-	var a uint32
-	var t uint32
-	var i uint32
-	var l uint32
-	var s uint32
-	binary.Read(answer, binary.BigEndian, &a)
-	binary.Read(answer, binary.BigEndian, &t)
-	binary.Read(answer, binary.BigEndian, &i)
-	binary.Read(answer, binary.BigEndian, &l)
-	binary.Read(answer, binary.BigEndian, &s)
-	peers = Peers{}
-	for answer.Len() > 0 {
-		peer := peer.NewPeer(answer, pm.OnPeers)
-		if peer == nil {
-			continue
+	err := p.Connect()
+	if err == nil {
+		// log.WithFields(log.Fields{
+		// 	"peer": p,
+		// }).Debug("Peer connected")
+		err = p.Ping(context.Background())
+		if err != nil {
+			p.Stop()
 		}
-		peers = append(peers, peer)
+	} else {
+		// log.WithFields(log.Fields{
+		// 	"error": err,
+		// 	"peer":  p,
+		// }).Warn("Connection error")
 	}
-	return peers, nil
+	return err
 }
 
-func (pm *PeerManager) announceUDP(tracker string) Peers {
-	serverAddr, _ := net.ResolveUDPAddr("udp", strings.Replace(tracker, "udp://", "", 1))
-	rnd := r.New(r.NewSource(time.Now().UnixNano()))
-	transactionID := rnd.Int31()
-	port := int32(rnd.Intn(99) + 6800)
-
-	conn, err := net.ListenPacket("udp4", fmt.Sprintf(":%d", port))
-	if err != nil {
-		return Peers{}
+func (pm *PeerManager) NewAnnounce(event string) Announce {
+	uploaded, downloaded, left := pm.transfer()
+	return Announce{
+		InfoHash: fmt.Sprintf("%s", sha1.Sum([]byte(pm.Address))),
+		PeerID:   utils.GetPeerID(),
+		Port:     utils.GetFileserverPort(),
+		Uploaded: int(uploaded), Downloaded: int(downloaded),
+		Left: int(left), Compact: 1, NumWant: 30,
+		Event: event,
 	}
-	socket := conn.(*net.UDPConn)
-	defer socket.Close()
-
-	socket.SetDeadline(time.Now().Add(20 * time.Second))
-
-	connectionID, err := pm.connectUDPTracker(socket, serverAddr, transactionID)
+}
 
-	if err != nil {
-		// fmt.Println("Error: ", err)
-		return Peers{}
+// peerIsKnown tells if the peer is connected or queued already, pm must be locked
+func (pm *PeerManager) peerIsKnown(peer *peer.Peer) bool {
+	if peer.Address == "0.0.0.0" || peer.Address == utils.GetExternalIP() || peer.Address == "9.12.0.6" {
+		return true
 	}
-
-	peers, err := pm.announceUDPTracker(socket, serverAddr, transactionID, connectionID, port)
-
-	if err != nil {
-		// fmt.Println("Error: ", err)
-		return Peers{}
+	// banned peers are treated as known so nobody connects to them again
+	if reputation.IsBanned(peer.Address) {
+		return true
 	}
-	return peers
-
+	for _, b := range pm.Peers {
+		if b.HostPort() == peer.HostPort() {
+			return true
+		}
+	}
+	for _, b := range pm.pending {
+		if b.HostPort() == peer.HostPort() {
+			return true
+		}
+	}
+	return false
 }
 
-func (pm *PeerManager) announceTracker(tracker string) Peers {
-	pm.Trackers = append(pm.Trackers, tracker)
-	if strings.HasPrefix(tracker, "http://") {
-		return pm.announceHTTP(tracker)
+// announceTracker sends the event to the tracker and returns the peers it knows
+// and when it wants to hear from us again, keeping its stats.
+// Trackers failing too often are left alone for a while.
+func (pm *PeerManager) announceTracker(tracker string, event string) (Peers, time.Duration) {
+	if !trackerAvailable(tracker) {
+		log.WithFields(log.Fields{
+			"tracker": tracker,
+		}).Debug("Tracker backing off")
+		return Peers{}, 0
+	}
+	var peers Peers
+	var interval time.Duration
+	var err error
+	started := time.Now()
+	if strings.HasPrefix(tracker, "http://") || strings.HasPrefix(tracker, "https://") {
+		var res TrackerResponse
+		res, err = pm.announceHTTP(tracker, event)
+		peers, interval = res.Peers, res.NextAnnounce()
 	} else if strings.HasPrefix(tracker, "udp://") {
-		return pm.announceUDP(tracker)
+		if utils.HasProxy() {
+			// socks5 UDP ASSOCIATE isn't supported by Tor, so don't leak around the proxy
+			log.WithFields(log.Fields{
+				"tracker": tracker,
+			}).Debug("UDP tracker skipped, using proxy")
+			return Peers{}, 0
+		}
+		peers, interval, err = pm.announceUDP(tracker, event)
+	} else if strings.HasPrefix(tracker, "zero://") {
+		if event == EVENT_STOPPED {
+			// bootstrappers forget sites that aren't announced anymore by themselves
+			return Peers{}, 0
+		}
+		peers, err = pm.announceZero(tracker)
+	} else {
+		return Peers{}, 0
 	}
-	return Peers{}
+	recordAnnounce(tracker, len(peers), time.Since(started), err)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"tracker": tracker,
+			"err":     err,
+		}).Warn("Announce error")
+		return Peers{}, 0
+	}
+	return peers, interval
 }
 
 func (pq Peers) Len() int { return len(pq) }
 
+// Less puts free LAN peers first, then the least busy and best scored ones
 func (pq Peers) Less(i, j int) bool {
-	return pq[i].ActiveTasks < pq[j].ActiveTasks
+	li, lj := pq[i].Load(), pq[j].Load()
+	fi, fj := li >= MAX_PEER_TASKS, lj >= MAX_PEER_TASKS
+	if fi != fj {
+		return fj
+	}
+	if locali, localj := pq[i].IsLocal(), pq[j].IsLocal(); locali != localj {
+		return locali
+	}
+	if li != lj {
+		return li < lj
+	}
+	return pq[i].Score() > pq[j].Score()
 }
 
 func (pq Peers) Swap(i, j int) {
-	// pq[i], pq[j] = pq[j], pq[i]
+	pq[i], pq[j] = pq[j], pq[i]
 }
 
 func (pq *Peers) Push(x interface{}) {
@@ -366,3 +498,80 @@ func (pq *Peers) Pop() interface{} {
 	*pq = old[0 : n-1]
 	return item
 }
+
+// StartPex periodically asks connected peers for more peers of the site, while it's announced
+func (pm *PeerManager) StartPex() {
+	pm.Lock()
+	defer pm.Unlock()
+	if pm.pexStarted {
+		return
+	}
+	pm.pexStarted = true
+	if pm.stopAnnounce != nil {
+		go pm.pexLoop(pm.stopAnnounce)
+	}
+}
+
+func (pm *PeerManager) pexLoop(stop chan struct{}) {
+	ticker := time.NewTicker(PEX_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if len(pm.GetActivePeers()) < PEX_WANT {
+			pm.Pex()
+		}
+	}
+}
+
+// Pex asks every connected peer for new peers of the site
+func (pm *PeerManager) Pex() {
+	for _, p := range pm.GetActivePeers() {
+		go pm.pexPeer(p)
+	}
+}
+
+func (pm *PeerManager) pexPeer(p *peer.Peer) {
+	pex, err := p.Pex(context.Background(), pm.Address, pm.PackedPeers(PEX_NEED, p), PEX_NEED)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"peer": p,
+			"err":  err,
+		}).Debug("Pex error")
+		return
+	}
+	c := pm.AddPacked(pex)
+	log.WithFields(log.Fields{
+		"peer":  p,
+		"peers": c,
+	}).Debug("Pex peers added")
+}
+
+// PackedPeers returns up to need connected peers packed for pex, skipping the one asking
+func (pm *PeerManager) PackedPeers(need int, exclude *peer.Peer) peer.PexPeers {
+	packed := peer.NewPexPeers()
+	for _, p := range pm.GetActivePeers() {
+		if packed.Len() >= need {
+			break
+		}
+		if exclude != nil && p.Address == exclude.Address {
+			continue
+		}
+		packed.Add(p)
+	}
+	return packed
+}
+
+// AddPacked adds peers received through pex, returns how many of them were new
+func (pm *PeerManager) AddPacked(packed peer.PexPeers) int {
+	c := 0
+	for _, p := range packed.Unpack() {
+		if pm.AddPeer(p) {
+			c++
+		}
+	}
+	return c
+}
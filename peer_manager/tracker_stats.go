@@ -0,0 +1,144 @@
+package peer_manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// failures in a row a tracker is allowed before backing off
+const TRACKER_MAX_FAILS = 3
+
+// first back off, doubled with every next failure
+const TRACKER_BACKOFF = time.Minute
+const TRACKER_MAX_BACKOFF = time.Hour
+
+const TRACKER_STATS_FILENAME = "trackers.json"
+
+type TrackerStats struct {
+	Tracker      string    `json:"tracker"`
+	LastAnnounce time.Time `json:"last_announce"`
+	Successes    int       `json:"successes"`
+	Failures     int       `json:"failures"`
+	// failures since the last success
+	FailsInRow int    `json:"fails_in_row"`
+	LastError  string `json:"last_error"`
+	LastPeers  int    `json:"last_peers"`
+	TotalPeers int    `json:"total_peers"`
+	// seconds of the last successful announce
+	Latency      float64   `json:"latency"`
+	BackoffUntil time.Time `json:"backoff_until"`
+}
+
+var trackerStats map[string]*TrackerStats
+var trackerStatsLock sync.Mutex
+
+// loadTrackerStats reads the saved stats once, trackerStatsLock must be held
+func loadTrackerStats() {
+	if trackerStats != nil {
+		return
+	}
+	trackerStats = map[string]*TrackerStats{}
+	filename := path.Join(utils.GetDataPath(), TRACKER_STATS_FILENAME)
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(content, &trackerStats)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't load tracker stats")
+	}
+}
+
+// saveTrackerStats writes the stats to disk, trackerStatsLock must be held
+func saveTrackerStats() {
+	filename := path.Join(utils.GetDataPath(), TRACKER_STATS_FILENAME)
+	content, err := json.MarshalIndent(trackerStats, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filename, content, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't save tracker stats")
+	}
+}
+
+func trackerAvailable(tracker string) bool {
+	trackerStatsLock.Lock()
+	defer trackerStatsLock.Unlock()
+	loadTrackerStats()
+	stats, ok := trackerStats[tracker]
+	return !ok || time.Now().After(stats.BackoffUntil)
+}
+
+func recordAnnounce(tracker string, peers int, latency time.Duration, err error) {
+	trackerStatsLock.Lock()
+	defer trackerStatsLock.Unlock()
+	loadTrackerStats()
+	stats, ok := trackerStats[tracker]
+	if !ok {
+		stats = &TrackerStats{Tracker: tracker}
+		trackerStats[tracker] = stats
+	}
+	now := time.Now()
+	stats.LastAnnounce = now
+	if err != nil {
+		stats.Failures++
+		stats.FailsInRow++
+		stats.LastError = err.Error()
+		if stats.FailsInRow >= TRACKER_MAX_FAILS {
+			backoff := TRACKER_BACKOFF << uint(stats.FailsInRow-TRACKER_MAX_FAILS)
+			if backoff > TRACKER_MAX_BACKOFF || backoff <= 0 {
+				backoff = TRACKER_MAX_BACKOFF
+			}
+			stats.BackoffUntil = now.Add(backoff)
+		}
+	} else {
+		stats.Successes++
+		stats.FailsInRow = 0
+		stats.LastPeers = peers
+		stats.TotalPeers += peers
+		stats.Latency = latency.Seconds()
+		stats.BackoffUntil = time.Time{}
+	}
+	saveTrackerStats()
+}
+
+// GetTrackerStats returns the stats of the configured trackers, plus any other ever used
+func GetTrackerStats() []TrackerStats {
+	trackerStatsLock.Lock()
+	defer trackerStatsLock.Unlock()
+	loadTrackerStats()
+	res := []TrackerStats{}
+	seen := map[string]bool{}
+	for _, tracker := range utils.GetTrackers() {
+		seen[tracker] = true
+		if stats, ok := trackerStats[tracker]; ok {
+			res = append(res, *stats)
+		} else {
+			res = append(res, TrackerStats{Tracker: tracker})
+		}
+	}
+	others := []TrackerStats{}
+	for tracker, stats := range trackerStats {
+		if !seen[tracker] {
+			others = append(others, *stats)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].Tracker < others[j].Tracker })
+	return append(res, others...)
+}
@@ -0,0 +1,288 @@
+package peer_manager
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	r "math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// BEP 15 actions
+const (
+	UDP_REQUEST_CONNECT  = 0
+	UDP_REQUEST_ANNOUNCE = 1
+	UDP_REQUEST_SCRAPE   = 2
+	UDP_ERROR            = 3
+)
+
+// magic connection id of connect requests
+const UDP_PROTOCOL_ID = int64(0x41727101980)
+
+// first retransmit timeout, doubled after every try
+const UDP_TIMEOUT = 15 * time.Second
+
+// retransmits before giving up, the BEP allows up to 8 but trackers answering that late are useless
+const UDP_MAX_RETRIES = 2
+
+// a connection id may be used for that long after the tracker gave it
+const UDP_CONNECTION_TTL = time.Minute
+
+// udp announce event codes
+var UDP_EVENTS = map[string]int32{
+	EVENT_NONE:      0,
+	EVENT_COMPLETED: 1,
+	EVENT_STARTED:   2,
+	EVENT_STOPPED:   3,
+}
+
+type udpConnection struct {
+	id      int64
+	expires time.Time
+}
+
+// udpClient talks to every udp tracker through a single socket, matching answers by transaction id
+type udpClient struct {
+	conn        *net.UDPConn
+	pending     map[int32]chan []byte
+	connections map[string]udpConnection
+	rnd         *r.Rand
+	sync.Mutex
+}
+
+var udpTrackers *udpClient
+var udpTrackersLock sync.Mutex
+
+// getUDPClient opens the shared socket on first use
+func getUDPClient() (*udpClient, error) {
+	udpTrackersLock.Lock()
+	defer udpTrackersLock.Unlock()
+	if udpTrackers != nil {
+		return udpTrackers, nil
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	udpTrackers = &udpClient{
+		conn:        conn,
+		pending:     map[int32]chan []byte{},
+		connections: map[string]udpConnection{},
+		rnd:         r.New(r.NewSource(time.Now().UnixNano())),
+	}
+	go udpTrackers.serve()
+	return udpTrackers, nil
+}
+
+func (c *udpClient) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"err": err,
+			}).Warn("UDP tracker socket closed")
+			udpTrackersLock.Lock()
+			udpTrackers = nil
+			udpTrackersLock.Unlock()
+			return
+		}
+		if n < 8 {
+			continue
+		}
+		tid := int32(binary.BigEndian.Uint32(buf[4:8]))
+		c.Lock()
+		ch, ok := c.pending[tid]
+		delete(c.pending, tid)
+		c.Unlock()
+		if ok {
+			ch <- append([]byte{}, buf[:n]...)
+		}
+	}
+}
+
+// request sends the action with the given body, retransmitting with a doubling timeout,
+// and returns the body of the answer. connectionID is asked again for every try,
+// so retries after a long wait don't use an expired connection id.
+func (c *udpClient) request(addr *net.UDPAddr, action int32, connectionID func() (int64, error), body []byte) ([]byte, error) {
+	timeout := UDP_TIMEOUT
+	for try := 0; try <= UDP_MAX_RETRIES; try++ {
+		id, err := connectionID()
+		if err != nil {
+			return nil, err
+		}
+		ch := make(chan []byte, 1)
+		c.Lock()
+		tid := c.rnd.Int31()
+		c.pending[tid] = ch
+		c.Unlock()
+		packet := new(bytes.Buffer)
+		binary.Write(packet, binary.BigEndian, id)
+		binary.Write(packet, binary.BigEndian, action)
+		binary.Write(packet, binary.BigEndian, tid)
+		packet.Write(body)
+		if _, err := c.conn.WriteToUDP(packet.Bytes(), addr); err != nil {
+			c.forget(tid)
+			return nil, err
+		}
+		select {
+		case answer := <-ch:
+			got := int32(binary.BigEndian.Uint32(answer[0:4]))
+			if got == UDP_ERROR {
+				return nil, fmt.Errorf("Tracker error: %s", answer[8:])
+			}
+			if got != action {
+				return nil, fmt.Errorf("Bad tracker answer: action %d instead of %d", got, action)
+			}
+			return answer[8:], nil
+		case <-time.After(timeout):
+			c.forget(tid)
+		}
+		timeout *= 2
+	}
+	return nil, fmt.Errorf("Tracker timed out")
+}
+
+func (c *udpClient) forget(tid int32) {
+	c.Lock()
+	delete(c.pending, tid)
+	c.Unlock()
+}
+
+// connectionID returns the cached connection id of the tracker, connecting when it expired
+func (c *udpClient) connectionID(addr *net.UDPAddr) (int64, error) {
+	c.Lock()
+	conn, ok := c.connections[addr.String()]
+	c.Unlock()
+	if ok && time.Now().Before(conn.expires) {
+		return conn.id, nil
+	}
+	answer, err := c.request(addr, UDP_REQUEST_CONNECT, func() (int64, error) {
+		return UDP_PROTOCOL_ID, nil
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(answer) < 8 {
+		return 0, fmt.Errorf("Bad tracker answer: connect too short")
+	}
+	id := int64(binary.BigEndian.Uint64(answer[0:8]))
+	c.Lock()
+	c.connections[addr.String()] = udpConnection{id, time.Now().Add(UDP_CONNECTION_TTL)}
+	c.Unlock()
+	return id, nil
+}
+
+// call runs a request that needs a connection id
+func (c *udpClient) call(addr *net.UDPAddr, action int32, body []byte) ([]byte, error) {
+	return c.request(addr, action, func() (int64, error) {
+		return c.connectionID(addr)
+	}, body)
+}
+
+func resolveUDPTracker(tracker string) (*net.UDPAddr, error) {
+	hostPort := strings.TrimPrefix(tracker, "udp://")
+	if i := strings.Index(hostPort, "/"); i != -1 {
+		hostPort = hostPort[:i]
+	}
+	return net.ResolveUDPAddr("udp4", hostPort)
+}
+
+func (pm *PeerManager) announceUDP(tracker string, event string) (Peers, time.Duration, error) {
+	addr, err := resolveUDPTracker(tracker)
+	if err != nil {
+		return Peers{}, 0, err
+	}
+	client, err := getUDPClient()
+	if err != nil {
+		return Peers{}, 0, err
+	}
+	infoHash := sha1.Sum([]byte(pm.Address))
+	uploaded, downloaded, left := pm.transfer()
+	client.Lock()
+	key := client.rnd.Uint32()
+	client.Unlock()
+	body := new(bytes.Buffer)
+	data := []interface{}{
+		infoHash,
+		[]byte(utils.GetPeerID()[0:20]),
+		downloaded,
+		left,
+		uploaded,
+		UDP_EVENTS[event],
+		uint32(0), // ip, the sender's
+		key,
+		int32(50),
+		uint16(utils.GetFileserverPort()),
+	}
+	for _, v := range data {
+		binary.Write(body, binary.BigEndian, v)
+	}
+	log.WithFields(log.Fields{
+		"tracker": addr.String(),
+		"event":   event,
+	}).Debug("Announce UDP tracker")
+	answer, err := client.call(addr, UDP_REQUEST_ANNOUNCE, body.Bytes())
+	if err != nil {
+		return Peers{}, 0, err
+	}
+	if len(answer) < 12 {
+		return Peers{}, 0, fmt.Errorf("Bad tracker answer: announce too short")
+	}
+	interval := time.Duration(binary.BigEndian.Uint32(answer[0:4])) * time.Second
+	reader := bytes.NewReader(answer[12:])
+	peers := Peers{}
+	for reader.Len() >= 6 {
+		p := peer.NewPeer(reader)
+		if p == nil {
+			continue
+		}
+		peers = append(peers, p)
+	}
+	return peers, interval, nil
+}
+
+type ScrapeResult struct {
+	Seeders   int `json:"seeders"`
+	Completed int `json:"completed"`
+	Leechers  int `json:"leechers"`
+}
+
+// Scrape asks the tracker how many peers have the site without announcing us
+func (pm *PeerManager) Scrape(tracker string) (ScrapeResult, error) {
+	if !strings.HasPrefix(tracker, "udp://") {
+		return ScrapeResult{}, fmt.Errorf("Scrape isn't supported by %s", tracker)
+	}
+	if utils.HasProxy() {
+		return ScrapeResult{}, fmt.Errorf("UDP trackers are disabled with a proxy")
+	}
+	addr, err := resolveUDPTracker(tracker)
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	client, err := getUDPClient()
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	infoHash := sha1.Sum([]byte(pm.Address))
+	answer, err := client.call(addr, UDP_REQUEST_SCRAPE, infoHash[:])
+	if err != nil {
+		return ScrapeResult{}, err
+	}
+	if len(answer) < 12 {
+		return ScrapeResult{}, fmt.Errorf("Bad tracker answer: scrape too short")
+	}
+	return ScrapeResult{
+		Seeders:   int(binary.BigEndian.Uint32(answer[0:4])),
+		Completed: int(binary.BigEndian.Uint32(answer[4:8])),
+		Leechers:  int(binary.BigEndian.Uint32(answer[8:12])),
+	}, nil
+}
@@ -0,0 +1,168 @@
+package peer_manager
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// announces of other sites arriving within that time share the same request
+const ZERO_BATCH_WAIT = time.Second
+
+// max site hashes per announce request
+const ZERO_BATCH_SIZE = 50
+
+// peers asked per announced site
+const ZERO_NEED_NUM = 20
+
+const ZERO_ANNOUNCE_TIMEOUT = 30 * time.Second
+
+type zeroAnnounce struct {
+	address string
+	result  chan zeroResult
+}
+
+type zeroResult struct {
+	peers Peers
+	err   error
+}
+
+// zeroTracker collects the announces of every site for one bootstrapper
+// and sends them together
+type zeroTracker struct {
+	tracker string
+	pending []*zeroAnnounce
+	sync.Mutex
+}
+
+var zeroTrackers = map[string]*zeroTracker{}
+var zeroTrackersLock sync.Mutex
+
+func getZeroTracker(tracker string) *zeroTracker {
+	zeroTrackersLock.Lock()
+	defer zeroTrackersLock.Unlock()
+	zt, ok := zeroTrackers[tracker]
+	if !ok {
+		zt = &zeroTracker{tracker: tracker}
+		zeroTrackers[tracker] = zt
+	}
+	return zt
+}
+
+func (pm *PeerManager) announceZero(tracker string) (Peers, error) {
+	return getZeroTracker(tracker).announce(pm.Address)
+}
+
+// announce queues the site for the next batch and waits for its peers
+func (zt *zeroTracker) announce(address string) (Peers, error) {
+	a := &zeroAnnounce{address: address, result: make(chan zeroResult, 1)}
+	zt.Lock()
+	zt.pending = append(zt.pending, a)
+	if len(zt.pending) == 1 {
+		time.AfterFunc(ZERO_BATCH_WAIT, zt.flush)
+	}
+	zt.Unlock()
+	res := <-a.result
+	return res.peers, res.err
+}
+
+func (zt *zeroTracker) flush() {
+	zt.Lock()
+	batch := zt.pending
+	zt.pending = nil
+	zt.Unlock()
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > ZERO_BATCH_SIZE {
+			n = ZERO_BATCH_SIZE
+		}
+		zt.send(batch[:n])
+		batch = batch[n:]
+	}
+}
+
+func (zt *zeroTracker) send(batch []*zeroAnnounce) {
+	results := make([]Peers, len(batch))
+	var err error
+	defer func() {
+		for i, a := range batch {
+			a.result <- zeroResult{results[i], err}
+		}
+	}()
+	p, pin, err := zeroTrackerPeer(zt.tracker)
+	if err == nil {
+		err = p.ConnectPinned(pin)
+	}
+	// the connection may come from a site sharing the peer, without the pin check
+	if err == nil {
+		err = p.CheckPin(pin)
+	}
+	if err == peer.ErrCertPin {
+		log.WithFields(log.Fields{
+			"tracker": zt.tracker,
+			"cert":    p.GetCertHash(),
+		}).Warn("Zero tracker certificate mismatch")
+		p.Stop()
+	}
+	if err != nil {
+		return
+	}
+	hashes := [][]byte{}
+	for _, a := range batch {
+		hash := sha256.Sum256([]byte(a.address))
+		hashes = append(hashes, hash[:])
+	}
+	log.WithFields(log.Fields{
+		"tracker": zt.tracker,
+		"sites":   len(hashes),
+	}).Debug("Announce zero tracker")
+	ctx, cancel := context.WithTimeout(context.Background(), ZERO_ANNOUNCE_TIMEOUT)
+	defer cancel()
+	sites, err := p.Announce(ctx, hashes, utils.GetFileserverPort(), openedTypes(), ZERO_NEED_NUM)
+	if err != nil {
+		return
+	}
+	for i, packed := range sites {
+		results[i] = packed.Unpack()
+	}
+}
+
+// openedTypes returns the address types others can connect to us with
+func openedTypes() []string {
+	if utils.GetFileserverPort() == 0 || utils.HasProxy() {
+		return []string{}
+	}
+	if ip := net.ParseIP(utils.GetExternalIP()); ip != nil && ip.To4() == nil {
+		return []string{"ipv6"}
+	}
+	return []string{"ipv4"}
+}
+
+// zeroTrackerPeer returns the shared peer of a zero://host:port or zero://host#pin:port tracker,
+// with the sha256 its certificate has to match, if pinned
+func zeroTrackerPeer(tracker string) (*peer.Peer, string, error) {
+	address := strings.TrimPrefix(tracker, "zero://")
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, "", fmt.Errorf("Bad tracker address %s: %v", tracker, err)
+	}
+	pin := ""
+	if parts := strings.SplitN(host, "#", 2); len(parts) == 2 {
+		host, pin = parts[0], parts[1]
+	}
+	port, _ := strconv.Atoi(portStr)
+	p := peer.NewPeerFromAddress(host, port)
+	if p == nil {
+		return nil, "", fmt.Errorf("Bad tracker address %s", tracker)
+	}
+	return peer.Shared(p), pin, nil
+}
@@ -0,0 +1,161 @@
+package peer_manager
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/G1itchZero/ZeroGo/peer"
+	"github.com/G1itchZero/ZeroGo/utils"
+	msgpack "gopkg.in/vmihailenco/msgpack.v2"
+)
+
+// fakeBootstrapper answers handshakes and announces like a ZeroNet bootstrapper,
+// giving two peers for every announced hash
+type fakeBootstrapper struct {
+	listener   net.Listener
+	pin        string
+	handshakes int32
+	announces  int32
+	hashes     int32
+}
+
+func newFakeBootstrapper(t *testing.T) *fakeBootstrapper {
+	dir, err := ioutil.TempDir("", "zero_tracker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.DATA = dir
+	utils.CreateCerts()
+	cert, err := tls.LoadX509KeyPair(path.Join(dir, "cert-rsa.pem"), path.Join(dir, "key-rsa.pem"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBootstrapper{
+		listener: l,
+		pin:      fmt.Sprintf("%x", sha256.Sum256(cert.Certificate[0])),
+	}
+	go b.serve()
+	return b
+}
+
+func (b *fakeBootstrapper) tracker(pin string) string {
+	addr := b.listener.Addr().(*net.TCPAddr)
+	if pin != "" {
+		return fmt.Sprintf("zero://127.0.0.1#%s:%d", pin, addr.Port)
+	}
+	return fmt.Sprintf("zero://127.0.0.1:%d", addr.Port)
+}
+
+func (b *fakeBootstrapper) close() {
+	b.listener.Close()
+	os.RemoveAll(utils.DATA)
+}
+
+func (b *fakeBootstrapper) serve() {
+	for {
+		c, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(c)
+	}
+}
+
+func (b *fakeBootstrapper) handle(c net.Conn) {
+	defer c.Close()
+	decoder := msgpack.NewDecoder(bufio.NewReader(c))
+	for {
+		req := map[string]interface{}{}
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		answer := map[string]interface{}{"cmd": "response", "to": req["req_id"]}
+		switch req["cmd"] {
+		case "handshake":
+			atomic.AddInt32(&b.handshakes, 1)
+			answer["protocol"] = peer.PROTOCOL
+			answer["peer_id"] = "-FAKEBOOT-0123456789"
+		case "ping":
+			answer["body"] = "Pong!"
+		case "announce":
+			atomic.AddInt32(&b.announces, 1)
+			params := req["params"].(map[interface{}]interface{})
+			sites := []interface{}{}
+			for i := range params["hashes"].([]interface{}) {
+				atomic.AddInt32(&b.hashes, 1)
+				ipv4, _ := peer.PackAddress("127.0.0.1", 30000+i)
+				ipv6, _ := peer.PackAddress("::1", 31000+i)
+				sites = append(sites, map[string]interface{}{
+					"ipv4": [][]byte{ipv4},
+					"ipv6": [][]byte{ipv6},
+				})
+			}
+			answer["peers"] = sites
+		}
+		data, _ := msgpack.Marshal(answer)
+		c.Write(data)
+	}
+}
+
+func TestZeroAnnounceBatchesSites(t *testing.T) {
+	b := newFakeBootstrapper(t)
+	defer b.close()
+	sites := []string{"1SiteA", "1SiteB", "1SiteC"}
+	results := make([]Peers, len(sites))
+	var wg sync.WaitGroup
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site string) {
+			defer wg.Done()
+			results[i], _ = NewPeerManager(site).announceZero(b.tracker(b.pin))
+		}(i, site)
+	}
+	wg.Wait()
+	announces, hashes := atomic.LoadInt32(&b.announces), atomic.LoadInt32(&b.hashes)
+	if announces != 1 || hashes != int32(len(sites)) {
+		t.Fatalf("%d announces for %d hashes, expected a single one", announces, hashes)
+	}
+	for i, peers := range results {
+		if len(peers) != 2 {
+			t.Fatalf("%s got %d peers instead of 2", sites[i], len(peers))
+		}
+	}
+}
+
+func TestZeroAnnounceWithoutPin(t *testing.T) {
+	b := newFakeBootstrapper(t)
+	defer b.close()
+	peers, err := NewPeerManager("1SiteA").announceZero(b.tracker(""))
+	if err != nil || len(peers) != 2 {
+		t.Fatalf("got %v, %v", peers, err)
+	}
+}
+
+func TestZeroAnnounceRefusesWrongPin(t *testing.T) {
+	b := newFakeBootstrapper(t)
+	defer b.close()
+	wrong := fmt.Sprintf("%x", sha256.Sum256([]byte("someone else")))
+	peers, err := NewPeerManager("1SiteA").announceZero(b.tracker(wrong))
+	if err != peer.ErrCertPin || len(peers) != 0 {
+		t.Fatalf("got %v, %v", peers, err)
+	}
+	if atomic.LoadInt32(&b.announces) != 0 {
+		t.Fatal("announced to a tracker with the wrong certificate")
+	}
+	if atomic.LoadInt32(&b.handshakes) != 0 {
+		t.Fatal("sent a handshake to a tracker with the wrong certificate")
+	}
+}
@@ -0,0 +1,239 @@
+package reputation
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/G1itchZero/ZeroGo/utils"
+	log "github.com/Sirupsen/logrus"
+)
+
+// penalty points per kind of failure
+const HASH_ERROR_PENALTY = 5
+const PROTOCOL_ERROR_PENALTY = 2
+const TIMEOUT_PENALTY = 1
+
+// peers reaching that many points get banned
+const BAN_THRESHOLD = 10
+
+// first ban length, doubled with every next ban of the same peer
+const BAN_TIME = 30 * time.Minute
+const MAX_BAN_TIME = 24 * time.Hour
+
+// penalty points are forgiven after that long without failures
+const FORGIVE_TIME = time.Hour
+
+// past bans are remembered that long after the last failure, so repeated bans keep growing
+const BAN_MEMORY = 7 * 24 * time.Hour
+
+const FILENAME = "peers_reputation.json"
+
+// changes are written together at most that long after the first one
+const SAVE_DELAY = 30 * time.Second
+
+type Record struct {
+	HashErrors     int       `json:"hash_errors"`
+	ProtocolErrors int       `json:"protocol_errors"`
+	Timeouts       int       `json:"timeouts"`
+	Penalty        int       `json:"penalty"`
+	Bans           int       `json:"bans"`
+	LastFailure    time.Time `json:"last_failure"`
+	BannedUntil    time.Time `json:"banned_until"`
+}
+
+// Banned tells if the peer is banned at the given time
+func (r *Record) Banned(now time.Time) bool {
+	return now.Before(r.BannedUntil)
+}
+
+// Store keeps the reputation of peers by address, shared by every site
+type Store struct {
+	Records  map[string]*Record
+	filename string
+	saving   bool
+	sync.Mutex
+}
+
+var store *Store
+var storeOnce sync.Once
+
+// GetStore returns the store, loading it from the data dir on first use
+func GetStore() *Store {
+	storeOnce.Do(func() {
+		store = NewStore(path.Join(utils.GetDataPath(), FILENAME))
+	})
+	return store
+}
+
+func NewStore(filename string) *Store {
+	s := &Store{
+		Records:  map[string]*Record{},
+		filename: filename,
+	}
+	if err := s.load(); err != nil {
+		log.WithFields(log.Fields{
+			"file": filename,
+			"err":  err,
+		}).Warn("Can't load peers reputation")
+	}
+	s.prune(time.Now())
+	return s
+}
+
+func (s *Store) load() error {
+	content, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &s.Records)
+}
+
+// scheduleSave writes the store SAVE_DELAY after the first unsaved change, s must be locked
+func (s *Store) scheduleSave() {
+	if s.saving {
+		return
+	}
+	s.saving = true
+	time.AfterFunc(SAVE_DELAY, s.Flush)
+}
+
+// Flush writes the pending changes right away, to be called on exit
+func (s *Store) Flush() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.saving {
+		return
+	}
+	s.saving = false
+	s.prune(time.Now())
+	s.save()
+}
+
+// prune drops the records with nothing left to remember: not banned, forgiven,
+// and for peers banned before, past BAN_MEMORY
+func (s *Store) prune(now time.Time) {
+	for address, r := range s.Records {
+		keep := FORGIVE_TIME
+		if r.Bans > 0 {
+			keep = BAN_MEMORY
+		}
+		if !r.Banned(now) && now.Sub(r.LastFailure) > keep {
+			delete(s.Records, address)
+		}
+	}
+}
+
+// save writes the store to disk, s must be locked
+func (s *Store) save() {
+	content, err := json.MarshalIndent(s.Records, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(s.filename, content, 0644)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{
+			"file": s.filename,
+			"err":  err,
+		}).Warn("Can't save peers reputation")
+	}
+}
+
+func HashError(address string) bool {
+	return GetStore().HashError(address)
+}
+
+func ProtocolError(address string) bool {
+	return GetStore().ProtocolError(address)
+}
+
+func Timeout(address string) bool {
+	return GetStore().Timeout(address)
+}
+
+func IsBanned(address string) bool {
+	return GetStore().IsBanned(address)
+}
+
+func Flush() {
+	GetStore().Flush()
+}
+
+// HashError records data failing its hash check, returns true if the peer got banned
+func (s *Store) HashError(address string) bool {
+	return s.record(address, func(r *Record) int {
+		r.HashErrors++
+		return HASH_ERROR_PENALTY
+	})
+}
+
+// ProtocolError records a malformed or nonsensical answer, returns true if the peer got banned
+func (s *Store) ProtocolError(address string) bool {
+	return s.record(address, func(r *Record) int {
+		r.ProtocolErrors++
+		return PROTOCOL_ERROR_PENALTY
+	})
+}
+
+// Timeout records a request left unanswered, returns true if the peer got banned
+func (s *Store) Timeout(address string) bool {
+	return s.record(address, func(r *Record) int {
+		r.Timeouts++
+		return TIMEOUT_PENALTY
+	})
+}
+
+func (s *Store) record(address string, failure func(*Record) int) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	r, ok := s.Records[address]
+	if !ok {
+		r = &Record{}
+		s.Records[address] = r
+	}
+	if now.Sub(r.LastFailure) > FORGIVE_TIME {
+		r.Penalty = 0
+	}
+	r.Penalty += failure(r)
+	r.LastFailure = now
+	banned := false
+	if r.Penalty >= BAN_THRESHOLD && !r.Banned(now) {
+		ban := BAN_TIME << uint(r.Bans)
+		if ban > MAX_BAN_TIME || ban <= 0 {
+			ban = MAX_BAN_TIME
+		}
+		r.Bans++
+		r.Penalty = 0
+		r.BannedUntil = now.Add(ban)
+		banned = true
+		log.WithFields(log.Fields{
+			"peer":  address,
+			"until": r.BannedUntil,
+		}).Warn("Peer banned")
+	}
+	s.scheduleSave()
+	return banned
+}
+
+func (s *Store) IsBanned(address string) bool {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.Records[address]
+	return ok && r.Banned(time.Now())
+}
+
+func (s *Store) Get(address string) (Record, bool) {
+	s.Lock()
+	defer s.Unlock()
+	r, ok := s.Records[address]
+	if !ok {
+		return Record{}, false
+	}
+	return *r, true
+}
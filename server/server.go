@@ -127,8 +127,8 @@ func (s *Server) serveWrapper(ctx echo.Context) error {
 		return errors.New("No .bit name found")
 	}
 	log.Info(fmt.Sprintf("> %s", yellow(st.Address)))
-	s.Sites.Sites[url] = st
-	s.Sites.Sites[st.Address] = st
+	s.Sites.Set(url, st)
+	s.Sites.Set(st.Address, st)
 	wrapper := NewWrapper(st, ctx)
 	err := wrapper.Render(ctx)
 	if err != nil {
@@ -149,7 +149,7 @@ func (s *Server) serveInner(ctx echo.Context) error {
 	// }
 	root := path.Join(utils.GetDataPath(), name)
 	filename := path.Join(root, "index.html")
-	site := s.Sites.Sites[name]
+	site, _ := s.Sites.Lookup(name)
 	site.WaitFile("index.html")
 	return ctx.File(filename)
 }
@@ -159,7 +159,7 @@ func (s *Server) serveInnerStatic(ctx echo.Context) error {
 	url := ctx.Param("*")
 	root := path.Join(utils.GetDataPath(), name.Value)
 	filename := path.Join(root, url)
-	site := s.Sites.Sites[name.Value]
+	site, _ := s.Sites.Lookup(name.Value)
 	site.WaitFile(url)
 	return ctx.File(filename)
 }
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 	"sync"
 	"time"
 
@@ -16,6 +17,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// max time WaitFile waits for a single file
+const WAIT_FILE_TIMEOUT = 2 * time.Minute
+
 type Site struct {
 	Address     string
 	Path        string
@@ -69,7 +73,9 @@ func (site *Site) Download(ch chan *Site) {
 	}()
 	<-done
 	site.Content = site.Downloader.Content
-	site.Content.Set(false, "cloneable")
+	if site.Content != nil {
+		site.Content.Set(false, "cloneable")
+	}
 	site.LastPeers = site.Downloader.Peers.Count
 	site.initDB()
 	site.Ready = true
@@ -100,7 +106,7 @@ func (site *Site) handleEvents() {
 		case peersCount := <-site.Downloader.Peers.OnAnnounce:
 			site.OnChanges <- events.SiteEvent{Type: "peers_added", Payload: peersCount}
 			if len(utils.GetTrackers()) == a && site.Downloader.Peers.Count == 0 {
-				for _, task := range site.Downloader.Files {
+				for _, task := range site.Downloader.FileTasks() {
 					task.Finish()
 					task.Success = false
 				}
@@ -113,8 +119,13 @@ func (site *Site) handleEvents() {
 	}
 }
 
+// GetFile reads a file of the site, refusing paths leading out of its directory
 func (site *Site) GetFile(filename string) ([]byte, error) {
-	content, err := ioutil.ReadFile(path.Join(site.Path, filename))
+	fullPath := path.Join(site.Path, filename)
+	if !strings.HasPrefix(fullPath, path.Clean(site.Path)+"/") {
+		return nil, fmt.Errorf("Bad inner path: %s", filename)
+	}
+	content, err := ioutil.ReadFile(fullPath)
 	if err == nil {
 		return content, nil
 	}
@@ -138,11 +149,24 @@ func (site *Site) Wait() {
 	}
 }
 
+// WaitFile blocks until the file is downloaded, requesting it if it's optional,
+// rescheduling it when the peers fail, and gives up after WAIT_FILE_TIMEOUT.
+// Files the site doesn't list fail right away once its content.json files are processed.
 func (site *Site) WaitFile(filename string) bool {
-	task, ok := site.Downloader.Files[filename]
+	deadline := time.Now().Add(WAIT_FILE_TIMEOUT)
+	task, ok := site.Downloader.File(filename)
 	for !ok && site.Success {
-		task, ok = site.Downloader.Files[filename]
-		// fmt.Println("waiting for", task, filename, ok, site.Downloader.Files)
+		listed := site.Downloader.Listed()
+		task, ok = site.Downloader.File(filename)
+		if !ok {
+			task, ok = site.Downloader.RequestOptional(filename)
+		}
+		if ok {
+			break
+		}
+		if listed || time.Now().After(deadline) {
+			return false
+		}
 		time.Sleep(time.Duration(time.Millisecond * 100))
 	}
 	if !site.Success {
@@ -150,6 +174,12 @@ func (site *Site) WaitFile(filename string) bool {
 	}
 	n := 0
 	for !task.Done && site.Success {
+		if time.Now().After(deadline) {
+			log.WithFields(log.Fields{
+				"task": task,
+			}).Warn("Waiting for file timed out")
+			return false
+		}
 		// fmt.Println("waiting for", task)
 		log.WithFields(log.Fields{
 			"task": task,
@@ -157,7 +187,7 @@ func (site *Site) WaitFile(filename string) bool {
 		time.Sleep(time.Duration(time.Millisecond * 100))
 		n++
 		task.Priority++
-		if n > 20 {
+		if n > 20 && !task.Started {
 			go site.Downloader.ScheduleFile(task)
 			n = 0
 		}
@@ -168,6 +198,7 @@ func (site *Site) WaitFile(filename string) bool {
 func (site *Site) GetSettings() SiteSettings {
 	size := 0.0
 	modified := 0.0
+	sizeOptional, optionalDownloaded := site.Downloader.OptionalSize()
 
 	if site.Content != nil {
 		modified = site.Content.Path("modified").Data().(float64)
@@ -180,11 +211,11 @@ func (site *Site) GetSettings() SiteSettings {
 
 		Added:              site.Added,
 		BytesRecv:          size,
-		OptionalDownloaded: 0,
+		OptionalDownloaded: int(optionalDownloaded),
 		BytesSent:          0,
 		Peers:              site.Downloader.Peers.Count,
 		Modified:           modified,
-		SizeOptional:       0,
+		SizeOptional:       int(sizeOptional),
 		Serving:            true,
 		Own:                false,
 		Permissions:        []string{"ADMIN"},
@@ -202,10 +233,10 @@ func (site *Site) GetInfo() SiteInfo {
 	}
 	return SiteInfo{
 		Address:  site.Address,
-		Files:    len(site.Downloader.Tasks) - 1,
+		Files:    len(site.Downloader.AllTasks()) - 1,
 		Peers:    peers,
 		Content:  content,
-		Workers:  len(site.Downloader.Peers.GetActivePeers()),
+		Workers:  site.Downloader.Peers.Workers(),
 		Tasks:    site.Downloader.PendingTasksCount(),
 		Settings: site.GetSettings(),
 
@@ -215,7 +246,7 @@ func (site *Site) GetInfo() SiteInfo {
 		// AuthKeySha512:  "",
 		// AuthKey:        "",
 		BadFiles:       0,
-		StartedTaskNum: site.Downloader.StartedTasks,
+		StartedTaskNum: site.Downloader.StartedTasks(),
 		ContentUpdated: 0,
 	}
 }
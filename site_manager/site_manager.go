@@ -6,9 +6,11 @@ import (
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/G1itchZero/ZeroGo/downloader"
+	"github.com/G1itchZero/ZeroGo/peer"
 	"github.com/G1itchZero/ZeroGo/site"
 	"github.com/G1itchZero/ZeroGo/utils"
 	"github.com/Jeffail/gabs"
@@ -17,9 +19,11 @@ import (
 )
 
 type SiteManager struct {
+	// by address and .bit name, the file server and the LAN discovery read it from their own goroutines
 	Sites  map[string]*site.Site
 	Names  map[string]interface{}
 	pbPool *pb.Pool
+	sync.RWMutex
 }
 
 func NewSiteManager() *SiteManager {
@@ -42,13 +46,35 @@ func (sm *SiteManager) LoadNames() {
 }
 
 func (sm *SiteManager) Remove(address string) {
-	site := sm.Sites[address]
-	go site.Remove()
+	sm.Lock()
+	site, ok := sm.Sites[address]
 	delete(sm.Sites, address)
+	sm.Unlock()
+	if !ok {
+		return
+	}
+	site.Downloader.Stop()
+	go site.Remove()
 	sm.SaveSites()
 }
 
+// Lookup returns a site we already have, by address or .bit name
+func (sm *SiteManager) Lookup(address string) (*site.Site, bool) {
+	sm.RLock()
+	defer sm.RUnlock()
+	s, ok := sm.Sites[address]
+	return s, ok
+}
+
+// Set makes the site known under that name too
+func (sm *SiteManager) Set(name string, s *site.Site) {
+	sm.Lock()
+	sm.Sites[name] = s
+	sm.Unlock()
+}
+
 func (sm *SiteManager) Get(address string) *site.Site {
+	sm.Lock()
 	s, ok := sm.Sites[address]
 	if !ok {
 		var bit string
@@ -56,6 +82,7 @@ func (sm *SiteManager) Get(address string) *site.Site {
 			bit = address
 			address, ok = sm.Names[address].(string)
 			if !ok {
+				sm.Unlock()
 				return nil
 			}
 		}
@@ -66,6 +93,7 @@ func (sm *SiteManager) Get(address string) *site.Site {
 			sm.Sites[bit] = s
 		}
 	}
+	sm.Unlock()
 	if !utils.GetDebug() {
 		sm.pbPool.Add(s.Downloader.ProgressBar)
 	}
@@ -74,6 +102,7 @@ func (sm *SiteManager) Get(address string) *site.Site {
 }
 
 func (sm *SiteManager) GetFiles(address string, filter downloader.FilterFunc) *site.Site {
+	sm.Lock()
 	s, ok := sm.Sites[address]
 	if !ok {
 		s = site.NewSite(address)
@@ -81,6 +110,7 @@ func (sm *SiteManager) GetFiles(address string, filter downloader.FilterFunc) *s
 		s.Added = int(time.Now().Unix())
 		sm.Sites[address] = s
 	}
+	sm.Unlock()
 	if !utils.GetDebug() {
 		sm.pbPool.Add(s.Downloader.ProgressBar)
 	}
@@ -97,6 +127,45 @@ func (sm *SiteManager) processSite(s *site.Site) {
 	}
 }
 
+// Pex adds the peers sent by a remote peer to the site and returns the ones we know
+func (sm *SiteManager) Pex(address string, packed peer.PexPeers, need int) (peer.PexPeers, bool) {
+	s, ok := sm.Lookup(address)
+	if !ok || s.Filter != nil {
+		return peer.PexPeers{}, false
+	}
+	s.Downloader.Peers.AddPacked(packed)
+	return s.Downloader.Peers.PackedPeers(need, nil), true
+}
+
+// Addresses returns the sites we serve to other peers
+func (sm *SiteManager) Addresses() []string {
+	sm.RLock()
+	defer sm.RUnlock()
+	addresses := []string{}
+	for address, s := range sm.Sites {
+		if s.Filter == nil && !strings.HasSuffix(address, ".bit") {
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// AddLocalPeer gives a peer found on the LAN to the site
+func (sm *SiteManager) AddLocalPeer(address string, p *peer.Peer) bool {
+	s, ok := sm.Lookup(address)
+	if !ok {
+		return false
+	}
+	return s.Downloader.Peers.AddLocalPeer(p)
+}
+
+// AddUploaded counts the bytes of the site served to other peers
+func (sm *SiteManager) AddUploaded(address string, bytes int) {
+	if s, ok := sm.Lookup(address); ok {
+		s.Downloader.Peers.AddUploaded(bytes)
+	}
+}
+
 func (sm *SiteManager) SaveSites() {
 	sites := sm.GetSites()
 	// log.Fatal(sites)
@@ -105,6 +174,8 @@ func (sm *SiteManager) SaveSites() {
 }
 
 func (sm *SiteManager) GetSites() *gabs.Container {
+	sm.RLock()
+	defer sm.RUnlock()
 	sites := gabs.New()
 	for addr, s := range sm.Sites {
 		if s.Content != nil && s.Filter == nil && !strings.HasSuffix(addr, ".bit") {
@@ -116,6 +187,8 @@ func (sm *SiteManager) GetSites() *gabs.Container {
 
 func (sm *SiteManager) updateSites() {
 	s, _ := loadSites()
+	sm.Lock()
+	defer sm.Unlock()
 	if s != nil {
 		sites, _ := s.ChildrenMap()
 		for address, content := range sites {
@@ -1,11 +1,14 @@
 package socket
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/G1itchZero/ZeroGo/downloader"
+	"github.com/G1itchZero/ZeroGo/peer_manager"
 	"github.com/G1itchZero/ZeroGo/site"
 	"github.com/G1itchZero/ZeroGo/site_manager"
 	"github.com/G1itchZero/ZeroGo/utils"
@@ -80,6 +83,14 @@ func (socket *UiSocket) Serve(ws *websocket.Conn) {
 		switch message.Cmd {
 		case "fileQuery":
 			go socket.fileQuery(message)
+		case "fileGet":
+			go socket.fileGet(message)
+		case "optionalFileList":
+			go socket.optionalFileList(message)
+		case "optionalFilePin":
+			go socket.optionalFilePin(message, true)
+		case "optionalFileUnpin":
+			go socket.optionalFilePin(message, false)
 		case "siteDelete":
 			go socket.siteDelete(message)
 		case "siteInfo":
@@ -104,6 +115,8 @@ func (socket *UiSocket) Serve(ws *websocket.Conn) {
 			go socket.siteList(message)
 		case "serverInfo":
 			go socket.Response(message.ID, GetServerInfo())
+		case "trackerStats":
+			go socket.Response(message.ID, peer_manager.GetTrackerStats())
 		case "feedQuery":
 			go socket.feedQuery(message)
 		case "dbQuery":
@@ -142,7 +155,11 @@ func (socket *UiSocket) siteList(message Message) {
 
 func (socket *UiSocket) fileQuery(message Message) {
 	filename := message.Params.([]interface{})[0].(string)
-	content, _ := socket.Site.GetFile(filename)
+	content, err := socket.Site.GetFile(filename)
+	if err != nil {
+		socket.Response(message.ID, []interface{}{})
+		return
+	}
 	if strings.HasSuffix(filename, ".json") {
 		jsonContent, _ := gabs.ParseJSON(content)
 		socket.Response(message.ID, []interface{}{jsonContent.Data()})
@@ -151,6 +168,93 @@ func (socket *UiSocket) fileQuery(message Message) {
 	}
 }
 
+// fileGet returns the content of a site file, waiting for it to download, optional ones included, when it's required
+func (socket *UiSocket) fileGet(message Message) {
+	filename, _ := param(message, "inner_path", 0).(string)
+	required, ok := param(message, "required", 1).(bool)
+	if !ok {
+		required = true
+	}
+	format, _ := param(message, "format", 2).(string)
+	if required && !socket.Site.WaitFile(filename) {
+		socket.Response(message.ID, nil)
+		return
+	}
+	content, err := socket.Site.GetFile(filename)
+	if err != nil {
+		socket.Response(message.ID, nil)
+		return
+	}
+	if format == "base64" {
+		socket.Response(message.ID, base64.StdEncoding.EncodeToString(content))
+	} else {
+		socket.Response(message.ID, string(content))
+	}
+}
+
+// optionalFileList takes ZeroNet's (address, orderby, limit, filter) params
+func (socket *UiSocket) optionalFileList(message Message) {
+	filter, ok := param(message, "filter", 3).(string)
+	if !ok {
+		filter = "downloaded"
+	}
+	limit := 10
+	if n, ok := param(message, "limit", 2).(float64); ok {
+		limit = int(n)
+	}
+	files := []downloader.OptionalFile{}
+	for _, file := range socket.Site.Downloader.OptionalFiles() {
+		if (filter == "downloaded" && !file.Downloaded) || (filter == "pinned" && !file.Pinned) {
+			continue
+		}
+		if limit > 0 && len(files) == limit {
+			break
+		}
+		files = append(files, file)
+	}
+	socket.Response(message.ID, files)
+}
+
+func (socket *UiSocket) optionalFilePin(message Message, pin bool) {
+	var filenames []string
+	switch p := param(message, "inner_path", 0).(type) {
+	case string:
+		filenames = []string{p}
+	case []interface{}:
+		for _, f := range p {
+			if s, ok := f.(string); ok {
+				filenames = append(filenames, s)
+			}
+		}
+	}
+	for _, filename := range filenames {
+		if !pin {
+			socket.Site.Downloader.Unpin(filename)
+		} else if !socket.Site.Downloader.Pin(filename) {
+			socket.Response(message.ID, map[string]string{"error": "Not an optional file: " + filename})
+			return
+		}
+	}
+	socket.Response(message.ID, "ok")
+}
+
+// param returns a parameter of the message, sent by name or by position
+func param(message Message, name string, index int) interface{} {
+	switch p := message.Params.(type) {
+	case map[string]interface{}:
+		return p[name]
+	case []interface{}:
+		if index < len(p) {
+			return p[index]
+		}
+	case string:
+		if index == 0 {
+			return p
+		}
+	}
+	return nil
+}
+
 func (socket *UiSocket) feedQuery(message Message) {
 	socket.Response(message.ID, []Post{
 		{
@@ -204,7 +308,7 @@ func GetServerInfo() ServerInfo {
 		Multiuser:      false,
 		TorEnabled:     false,
 		Plugins:        []string{},
-		FileserverPort: 15441,
+		FileserverPort: utils.GetFileserverPort(),
 		MasterAddress:  "15Ni39HLKXmnXHRkuh8Cpj43AtDfTwc9Gv",
 		Language:       "en",
 		UIPort:         43111,
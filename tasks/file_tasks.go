@@ -2,6 +2,7 @@ package tasks
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha512"
 	"fmt"
 	"io"
@@ -16,6 +17,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 )
 
+// downloads are written there, out of the site directory, until they pass their checks
+const STAGING_DIR = ".staging"
+
 type Tasks []*FileTask
 type FileTask struct {
 	Site       string
@@ -32,8 +36,13 @@ type FileTask struct {
 	Priority   int
 	Success    bool
 	FullPath   string
+	StagePath  string
 	Location   int
 	Stream     *os.File
+	// extra check of the downloaded content, like the signs of a content.json
+	Verify func([]byte) error
+	// the data being downloaded sits in StagePath
+	staged bool
 }
 
 func NewTask(filename string, hash string, size float64, site string, ch chan events.SiteEvent) *FileTask {
@@ -51,6 +60,7 @@ func NewTask(filename string, hash string, size float64, site string, ch chan ev
 		OnChanges: ch,
 		Priority:  p,
 		FullPath:  path.Join(utils.GetDataPath(), site, filename),
+		StagePath: path.Join(utils.GetDataPath(), STAGING_DIR, site, filename),
 		StartTime: time.Now(),
 	}
 	return &task
@@ -82,10 +92,12 @@ func (task *FileTask) AppendContent(content []byte, location int) {
 	}
 	if task.Stream == nil {
 		var err error
-		task.Stream, err = os.Create(task.FullPath)
+		os.MkdirAll(path.Dir(task.StagePath), 0777)
+		task.Stream, err = os.Create(task.StagePath)
 		if err != nil {
 			// panic?
 		}
+		task.staged = true
 	}
 	if (location == 0 && task.Location == 0) || location > task.Location {
 		task.Location = location
@@ -93,8 +105,14 @@ func (task *FileTask) AppendContent(content []byte, location int) {
 	}
 }
 
+// Check verifies the downloaded data, or the file on disk when nothing was downloaded.
+// A valid download is moved from StagePath into place.
 func (task *FileTask) Check() bool {
-	fc, err := ioutil.ReadFile(task.FullPath)
+	filename := task.FullPath
+	if task.staged {
+		filename = task.StagePath
+	}
+	fc, err := ioutil.ReadFile(filename)
 	if err != nil {
 		log.Warn(err)
 		return false
@@ -104,6 +122,27 @@ func (task *FileTask) Check() bool {
 		return false
 		// log.Fatal(fmt.Errorf("Hash error '%s': %s != %s", task.FullPath, task.Hash, hash))
 	}
+	if task.Verify != nil {
+		if err := task.Verify(fc); err != nil {
+			log.WithFields(log.Fields{
+				"task": task,
+				"err":  err,
+			}).Warn("Verification failed")
+			return false
+		}
+	}
+	if task.staged {
+		task.Stream.Close()
+		os.MkdirAll(path.Dir(task.FullPath), 0777)
+		if err := os.Rename(task.StagePath, task.FullPath); err != nil {
+			log.WithFields(log.Fields{
+				"task": task,
+				"err":  err,
+			}).Warn("Can't move the download into place")
+			return false
+		}
+		task.staged = false
+	}
 	return true
 }
 
@@ -119,6 +158,23 @@ func (task *FileTask) Start() {
 	task.Started = true
 }
 
+// Reset drops a partial or invalid download so the task can be started again from scratch
+func (task *FileTask) Reset() {
+	if task.Done {
+		return
+	}
+	if task.Stream != nil {
+		task.Stream.Close()
+		task.Stream = nil
+	}
+	if task.staged {
+		os.Remove(task.StagePath)
+		task.staged = false
+	}
+	task.Location = 0
+	task.Started = false
+}
+
 func (task *FileTask) GetStarted() bool {
 	return task.Started
 }
@@ -137,7 +193,7 @@ func (task *FileTask) Finish() {
 	}
 }
 
-func (task *FileTask) AddPeer(p interfaces.IPeer) error {
+func (task *FileTask) AddPeer(ctx context.Context, p interfaces.IPeer) error {
 	if task.Check() {
 		task.Finish()
 		return nil
@@ -146,7 +202,7 @@ func (task *FileTask) AddPeer(p interfaces.IPeer) error {
 		task.Peers = []interfaces.IPeer{}
 	}
 	task.Peers = append(task.Peers, p)
-	return p.AddTask(task)
+	return p.AddTask(ctx, task)
 }
 
 func (a Tasks) Len() int           { return len(a) }
@@ -0,0 +1,52 @@
+package tasks
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/G1itchZero/ZeroGo/utils"
+)
+
+func newTestTask(t *testing.T, content string) *FileTask {
+	dir, err := ioutil.TempDir("", "tasks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	utils.DATA = dir
+	hash := fmt.Sprintf("%x", sha512.Sum512([]byte(content)))[0:64]
+	return NewTask("js/all.js", hash, float64(len(content)), "1Site", nil)
+}
+
+func TestBadDownloadStaysOutOfSite(t *testing.T) {
+	task := newTestTask(t, "good")
+	defer os.RemoveAll(utils.DATA)
+	task.Start()
+	task.AppendContent([]byte("evil"), 0)
+	if task.Check() {
+		t.Fatal("tampered download passed the check")
+	}
+	if _, err := os.Stat(task.FullPath); !os.IsNotExist(err) {
+		t.Fatalf("tampered download written into the site: %v", err)
+	}
+	task.Reset()
+	if _, err := os.Stat(task.StagePath); !os.IsNotExist(err) {
+		t.Fatalf("tampered download left staged: %v", err)
+	}
+
+	task.Start()
+	task.AppendContent([]byte("good"), 0)
+	if !task.Check() {
+		t.Fatal("valid download failed the check")
+	}
+	task.Finish()
+	content, err := ioutil.ReadFile(task.FullPath)
+	if err != nil || string(content) != "good" {
+		t.Fatalf("got %q, %v", content, err)
+	}
+	if _, err := os.Stat(task.StagePath); !os.IsNotExist(err) {
+		t.Fatal("valid download left staged")
+	}
+}
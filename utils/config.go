@@ -0,0 +1,80 @@
+package utils
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+const CONFIG_FILENAME = "config.json"
+
+// Config holds the settings read from the config file, CLI flags override them
+type Config struct {
+	Trackers []string `json:"trackers"`
+	// host:port of peers every site connects to, whatever the trackers say
+	Peers []string `json:"peers"`
+	// static peers of single sites, by site address
+	SitePeers map[string][]string `json:"site_peers"`
+}
+
+var config = Config{}
+
+func GetConfigPath() string {
+	return path.Join(GetDataPath(), CONFIG_FILENAME)
+}
+
+// LoadConfig reads the json config file, a missing file leaves the defaults
+func LoadConfig(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c := Config{}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return fmt.Errorf("Bad config %s: %v", filename, err)
+	}
+	config = c
+	return nil
+}
+
+func GetConfig() Config {
+	return config
+}
+
+// SetTrackers replaces the trackers every site announces to
+func SetTrackers(trackers []string) {
+	config.Trackers = trackers
+}
+
+// AddStaticPeer adds a peer given as host:port for every site, or site=host:port for a single one
+func AddStaticPeer(s string) error {
+	site := ""
+	if i := strings.Index(s, "="); i != -1 {
+		site, s = s[:i], s[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		return fmt.Errorf("Bad peer %s: %v", s, err)
+	}
+	if site == "" {
+		config.Peers = append(config.Peers, s)
+		return nil
+	}
+	if config.SitePeers == nil {
+		config.SitePeers = map[string][]string{}
+	}
+	config.SitePeers[site] = append(config.SitePeers[site], s)
+	return nil
+}
+
+// GetStaticPeers returns host:port of the static peers of the site, the global ones included
+func GetStaticPeers(site string) []string {
+	peers := append([]string{}, config.Peers...)
+	return append(peers, config.SitePeers[site]...)
+}
@@ -0,0 +1,89 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+var proxyURL *url.URL
+var proxyDialer proxy.Dialer
+
+// SetProxy routes every outgoing peer and tracker connection through a socks5://host:port proxy
+func SetProxy(address string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return fmt.Errorf("Bad proxy address: %v", err)
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("Unsupported proxy scheme: %s", u.Scheme)
+	}
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+	dialer, err := proxy.SOCKS5("tcp", u.Host, auth, &net.Dialer{Timeout: 10 * time.Second})
+	if err != nil {
+		return fmt.Errorf("Proxy error: %v", err)
+	}
+	proxyURL = u
+	proxyDialer = dialer
+	return nil
+}
+
+func HasProxy() bool {
+	return proxyDialer != nil
+}
+
+func GetProxy() string {
+	if proxyURL == nil {
+		return ""
+	}
+	return proxyURL.String()
+}
+
+// Dial opens a connection, through the proxy if one is set.
+// Hostnames are resolved by the proxy, so nothing leaks around it.
+func Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	if proxyDialer == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+	res := make(chan dialResult, 1)
+	go func() {
+		conn, err := proxyDialer.Dial(network, address)
+		res <- dialResult{conn, err}
+	}()
+	select {
+	case r := <-res:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		go func() {
+			if r := <-res; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("Proxy dial %s timed out", address)
+	}
+}
+
+// GetHTTPClient returns a client for tracker and other http requests going through the proxy if set
+func GetHTTPClient() *http.Client {
+	client := &http.Client{Timeout: 30 * time.Second}
+	if proxyDialer != nil {
+		client.Transport = &http.Transport{
+			Dial: func(network, address string) (net.Conn, error) {
+				return Dial(network, address, 10*time.Second)
+			},
+		}
+	}
+	return client
+}
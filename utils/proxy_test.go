@@ -0,0 +1,171 @@
+package utils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// socks5Server is a stand-in proxy accepting CONNECT without auth. It connects every request
+// to target and records the addresses it was asked for.
+type socks5Server struct {
+	listener  net.Listener
+	target    string
+	requested chan string
+}
+
+func newSocks5Server(t *testing.T, target string) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socks5Server{l, target, make(chan string, 10)}
+	go s.serve()
+	return s
+}
+
+func (s *socks5Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socks5Server) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	// greeting: version, methods
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return
+	}
+	io.CopyN(ioutil.Discard, r, int64(head[1]))
+	conn.Write([]byte{5, 0})
+	// request: version, cmd, reserved, address type
+	req := make([]byte, 4)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 1 {
+		return
+	}
+	var host string
+	switch req[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		n, _ := r.ReadByte()
+		name := make([]byte, n)
+		io.ReadFull(r, name)
+		host = string(name)
+	default:
+		return
+	}
+	port := make([]byte, 2)
+	io.ReadFull(r, port)
+	s.requested <- net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	upstream, err := net.Dial("tcp", s.target)
+	if err != nil {
+		conn.Write([]byte{5, 1, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	go io.Copy(upstream, r)
+	io.Copy(conn, upstream)
+}
+
+func withProxy(t *testing.T, address string) {
+	if err := SetProxy(address); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func resetProxy() {
+	proxyURL = nil
+	proxyDialer = nil
+}
+
+func TestSetProxyRejectsOtherSchemes(t *testing.T) {
+	defer resetProxy()
+	if err := SetProxy("http://127.0.0.1:8080"); err == nil {
+		t.Fatal("http proxy accepted")
+	}
+	if HasProxy() {
+		t.Fatal("proxy set after an error")
+	}
+}
+
+func TestDialThroughProxy(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func(c net.Conn) {
+				defer c.Close()
+				io.Copy(c, c)
+			}(c)
+		}
+	}()
+	s := newSocks5Server(t, echo.Addr().String())
+	defer s.listener.Close()
+	withProxy(t, "socks5://"+s.listener.Addr().String())
+	defer resetProxy()
+
+	conn, err := Dial("tcp", "abcdefghijklmnop.onion:15441", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the hostname has to reach the proxy unresolved
+	if got := <-s.requested; got != "abcdefghijklmnop.onion:15441" {
+		t.Fatalf("proxy asked for %s", got)
+	}
+	conn.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through proxy: %q %v", buf, err)
+	}
+}
+
+func TestHTTPClientThroughProxy(t *testing.T) {
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.Path)
+	}))
+	defer tracker.Close()
+	s := newSocks5Server(t, tracker.Listener.Addr().String())
+	defer s.listener.Close()
+	withProxy(t, "socks5://"+s.listener.Addr().String())
+	defer resetProxy()
+
+	res, err := GetHTTPClient().Get("http://tracker.invalid:6969/announce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+	if string(body) != "/announce" {
+		t.Fatalf("unexpected answer %q", body)
+	}
+	if got := <-s.requested; got != "tracker.invalid:6969" {
+		t.Fatalf("proxy asked for %s", got)
+	}
+}
@@ -13,10 +13,11 @@ import (
 	"io/ioutil"
 	"math/big"
 	r "math/rand"
-	"net/http"
+	"net"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Jeffail/gabs"
@@ -40,6 +41,7 @@ const ZN_ID string = "1iD5ZQJMNXu43w1qLB8sfdHVKppVMduGz"
 
 var homepage string
 var debug bool
+var fileserverPort int
 
 func SetHomepage(hp string) {
 	homepage = hp
@@ -57,6 +59,15 @@ func GetHomepage() string {
 	return homepage
 }
 
+func SetFileserverPort(port int) {
+	fileserverPort = port
+}
+
+// GetFileserverPort returns the port our file server listens on, 0 if it's not running
+func GetFileserverPort() int {
+	return fileserverPort
+}
+
 func GetDataPath() string {
 	if DATA == "" {
 		DATA = path.Join(".", "data")
@@ -158,18 +169,24 @@ func GetBytes(key interface{}) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// DEFAULT_TRACKERS are used unless the config or the command line give others
+var DEFAULT_TRACKERS = []string{
+	"zero://boot3rdez4rzn36x.onion:15441",
+	"zero://boot.zeronet.io#f36ca555bee6ba216b14d10f38c16f7769ff064e0e37d887603548cc2e64191d:15441",
+	"udp://tracker.coppersurfer.tk:6969",
+	"udp://tracker.leechers-paradise.org:6969",
+	"udp://9.rarbg.com:2710",
+	"http://tracker.tordb.ml:6881/announce",
+	"http://explodie.org:6969/announce",
+	"http://tracker1.wasabii.com.tw:6969/announce",
+}
+
 func GetTrackers() []string {
-	trackers := []string{
-		// "zero://boot3rdez4rzn36x.onion:15441",
-		// "zero://boot.zeronet.io#f36ca555bee6ba216b14d10f38c16f7769ff064e0e37d887603548cc2e64191d:15441",
-		"udp://tracker.coppersurfer.tk:6969",
-		"udp://tracker.leechers-paradise.org:6969",
-		"udp://9.rarbg.com:2710",
-		"http://tracker.tordb.ml:6881/announce",
-		"http://explodie.org:6969/announce",
-		"http://tracker1.wasabii.com.tw:6969/announce",
+	// an empty list in the config means no trackers at all, for static peer only setups
+	if config.Trackers != nil {
+		return config.Trackers
 	}
-	return trackers
+	return DEFAULT_TRACKERS
 }
 
 func Exists(path string) (bool, error) {
@@ -184,17 +201,60 @@ func Exists(path string) (bool, error) {
 }
 
 var IP string
+var ipLock sync.Mutex
 
+// GetExternalIP returns our address as reported by the peers in their handshakes
 func GetExternalIP() string {
-	if IP != "" {
-		return IP
-	}
-	resp, _ := http.Get("http://myexternalip.com/raw")
-	defer resp.Body.Close()
-	ip, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
+	ipLock.Lock()
+	defer ipLock.Unlock()
+	if IP == "" {
 		return "0.0.0.0"
 	}
-	IP = strings.Trim(string(ip), "\n ")
 	return IP
 }
+
+// distinct peers that have to report the same target_ip before we take it as ours
+const EXTERNAL_IP_VOTES = 3
+
+// reported addresses kept at once, a flood of different ones starts the count over
+const EXTERNAL_IP_MAX_CANDIDATES = 100
+
+// reporters by reported ip
+var ipVotes = map[string]map[string]bool{}
+
+// SetExternalIP counts the target_ip the reporter saw us coming from, and takes it once
+// EXTERNAL_IP_VOTES distinct hosts agree, so a single peer can't make us skip another one.
+// Private and loopback addresses are ignored.
+func SetExternalIP(ip string, reporter string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsGlobalUnicast() || isPrivateIP(parsed) {
+		return
+	}
+	ip = parsed.String()
+	ipLock.Lock()
+	defer ipLock.Unlock()
+	if ip == IP {
+		return
+	}
+	if _, ok := ipVotes[ip]; !ok {
+		if len(ipVotes) >= EXTERNAL_IP_MAX_CANDIDATES {
+			ipVotes = map[string]map[string]bool{}
+		}
+		ipVotes[ip] = map[string]bool{}
+	}
+	ipVotes[ip][reporter] = true
+	if len(ipVotes[ip]) >= EXTERNAL_IP_VOTES {
+		IP = ip
+		ipVotes = map[string]map[string]bool{}
+	}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, block, _ := net.ParseCIDR(cidr)
+		if block.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}